@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 )
 
 type UserBanParams struct {
@@ -11,95 +12,99 @@ type UserBanParams struct {
 	Reason string `json:"reason"`
 }
 
-func validateUserBanParams(p UserBanParams) error {
-	err := validateEmail(p.Email)
+func (s *UserService) validateUserBanParams(p *UserBanParams) error {
+	email, err := s.normalizeEmail(p.Email)
 	if err != nil {
 		return err
 	}
+	p.Email = email
 	return nil
 }
 
-func isSuperadmin(u User, w http.ResponseWriter) bool {
-	if u.Role != superadminRole {
-		writeResponse(w, 401, "try to acces superadmin api without superadmin rights")
-		return false
-	}
-	return true
+type UserRoleParams struct {
+	Email string `json:"email"`
+	Role  Role   `json:"role"`
 }
 
-// func isAdminSuperadmin(u User, w http.ResponseWriter) bool {
-// 	if u.Role != adminRole {
-// 		handleError(errors.New("try to acces admin api without admin or superadmin rights"), w)
-// 		return false
-// 	}
-// 	return true
-// }
-
-func (s *UserService) promoteUser(w http.ResponseWriter, r *http.Request, u User) {
-	if !isSuperadmin(u, w) {
-		return
+func (s *UserService) validateAdminAction(w http.ResponseWriter, u User, target User) bool {
+	if s.policy.CanManage(u.Role, target.Role) {
+		return true
 	}
 
-	params, err := readParams(r)
+	writeResponse(w, 401, "not enough rights to performe this action")
+	return false
+}
+
+func (s *UserService) setRole(w http.ResponseWriter, u User, email string, role Role) bool {
+	user, err := s.repository.Get(email)
 	if err != nil {
 		handleError(err, w)
-		return
+		return false
 	}
 
-	user, err := s.repository.Get(params.Email)
-	if err != nil {
-		handleError(err, w)
-		return
+	if !s.validateAdminAction(w, u, user) {
+		return false
 	}
 
-	user.Role = adminRole
+	if !s.policy.HasRole(role) || !s.policy.CanManage(u.Role, role) {
+		writeResponse(w, 401, "not enough rights to performe this action")
+		return false
+	}
+
+	user.Role = role
 
 	err = s.repository.Update(user.Email, user)
 	if err != nil {
 		handleError(err, w)
-		return
+		return false
 	}
 
-	writeResponse(w, http.StatusOK, "user "+user.Email+" is admin now")
+	return true
 }
 
-func (s *UserService) fireUser(w http.ResponseWriter, r *http.Request, u User) {
-	if !isSuperadmin(u, w) {
+func (s *UserService) promoteUser(w http.ResponseWriter, r *http.Request, u User) {
+	params := &UserRoleParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
 		return
 	}
 
-	params, err := readParams(r)
+	if params.Role == "" {
+		params.Role = adminRole
+	}
+
+	params.Email, err = s.normalizeEmail(params.Email)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
 
-	user, err := s.repository.Get(params.Email)
-	if err != nil {
-		handleError(err, w)
+	if !s.setRole(w, u, params.Email, params.Role) {
 		return
 	}
 
-	user.Role = userRole
+	writeResponse(w, http.StatusOK, "user "+params.Email+" is "+params.Role.String()+" now")
+}
 
-	s.repository.Update(user.Email, user)
+func (s *UserService) fireUser(w http.ResponseWriter, r *http.Request, u User) {
+	params, err := readParams(r)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
 
-	writeResponse(w, http.StatusOK, "user "+user.Email+" is not admin now")
-}
-
-func validateAdminAction(w http.ResponseWriter, u User, target User) bool {
-	if (u.Role == adminRole || u.Role == superadminRole) && target.Role == userRole ||
-		u.Role == superadminRole && target.Role == adminRole {
+	params.Email, err = s.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
 
-		return true
+	if !s.setRole(w, u, params.Email, userRole) {
+		return
 	}
 
-	writeResponse(w, 401, "not enough rights to performe this action")
-	return false
+	writeResponse(w, http.StatusOK, "user "+params.Email+" is not admin now")
 }
 
 func (s *UserService) banUserHandler(w http.ResponseWriter, r *http.Request, u User) {
@@ -110,7 +115,7 @@ func (s *UserService) banUserHandler(w http.ResponseWriter, r *http.Request, u U
 		return
 	}
 
-	err = validateUserBanParams(*params)
+	err = s.validateUserBanParams(params)
 	if err != nil {
 		handleError(err, w)
 		return
@@ -122,7 +127,7 @@ func (s *UserService) banUserHandler(w http.ResponseWriter, r *http.Request, u U
 		return
 	}
 
-	if !validateAdminAction(w, u, target) {
+	if !s.validateAdminAction(w, u, target) {
 		return
 	}
 
@@ -147,7 +152,7 @@ func (s *UserService) unbanUserHandler(w http.ResponseWriter, r *http.Request, u
 		handleError(errors.New("could not read params"), w)
 	}
 
-	err = validateUserBanParams(*params)
+	err = s.validateUserBanParams(params)
 	if err != nil {
 		handleError(err, w)
 	}
@@ -157,7 +162,7 @@ func (s *UserService) unbanUserHandler(w http.ResponseWriter, r *http.Request, u
 		handleError(err, w)
 	}
 
-	if !validateAdminAction(w, u, target) {
+	if !s.validateAdminAction(w, u, target) {
 		return
 	}
 
@@ -171,13 +176,7 @@ func (s *UserService) unbanUserHandler(w http.ResponseWriter, r *http.Request, u
 }
 
 func (s *UserService) inspectUserHandler(w http.ResponseWriter, r *http.Request, u User) {
-	if u.Role != adminRole && u.Role != superadminRole {
-		writeResponse(w, 401, "not enough rights to performe this action")
-		return
-	}
-
-	email := r.URL.Query().Get("email")
-	err := validateEmail(email)
+	email, err := s.normalizeEmail(r.URL.Query().Get("email"))
 	if err != nil {
 		handleError(err, w)
 		return
@@ -189,13 +188,14 @@ func (s *UserService) inspectUserHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	history := target.BanHistory
-	if history == nil {
-		writeResponse(w, http.StatusOK, "user "+email+" does not have any bans")
-		return
+	response := "user " + email + " does not have any bans"
+	if target.BanHistory != nil {
+		response = InspectUser(target)
 	}
 
-	response := InspectUser(target)
+	if attempts := s.logins.List(target.Email); len(attempts) > 0 {
+		response = strings.TrimSuffix(response, "\n") + "\nlast logins:\n" + formatLogins(attempts)
+	}
 
 	writeResponse(w, http.StatusOK, response)
 }
@@ -4,7 +4,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/Hudanov/Cake-REST-API/config"
 )
 
 type Params = map[string]interface{}
@@ -16,7 +20,7 @@ func TestAdmin(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		adms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.promoteUser)))
+		adms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersPromote, u.promoteUser))))
 		defer func() {
 			adms.Close()
 		}()
@@ -70,7 +74,7 @@ func TestAdmin(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		adms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.fireUser)))
+		adms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersPromote, u.fireUser))))
 		defer func() {
 			adms.Close()
 		}()
@@ -174,7 +178,7 @@ func TestAdmin(t *testing.T) {
 			"password": DefaultPassword,
 		})))
 
-		assertResponse(t, 200, userJwt, resp)
+		assertSessionJWT(t, j, u, user.Email, resp)
 
 		req, err := http.NewRequest(http.MethodPost, cks.URL, nil) // get cake
 		req.Header.Add(
@@ -191,7 +195,7 @@ func TestAdmin(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		bans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.banUserHandler)))
+		bans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersBan, u.banUserHandler))))
 		defer func() {
 			bans.Close()
 		}()
@@ -247,7 +251,7 @@ func TestAdmin(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		unbans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.unbanUserHandler)))
+		unbans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersBan, u.unbanUserHandler))))
 		defer func() {
 			unbans.Close()
 		}()
@@ -286,7 +290,7 @@ func TestAdmin(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.inspectUserHandler)))
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
 		defer func() {
 			inspects.Close()
 		}()
@@ -320,7 +324,7 @@ func TestAdmin(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.inspectUserHandler)))
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
 		defer func() {
 			inspects.Close()
 		}()
@@ -347,7 +351,7 @@ func TestAdmin(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.inspectUserHandler)))
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
 		defer func() {
 			inspects.Close()
 		}()
@@ -367,15 +371,15 @@ func TestAdmin(t *testing.T) {
 
 		resp := doRequest(req, err)
 
-		assertResponse(t, 422, "Unvalid email address", resp)
+		assertResponse(t, 422, "invalid email address", resp)
 	})
 
 	t.Run("users can not acces admin api", func(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
 
-		bans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.banUserHandler)))
-		adms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.promoteUser)))
+		bans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersBan, u.banUserHandler))))
+		adms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersPromote, u.promoteUser))))
 		defer func() {
 			bans.Close()
 		}()
@@ -418,36 +422,225 @@ func TestAdmin(t *testing.T) {
 
 	})
 
+	t.Run("moderator from policy file", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		policy, err := LoadPolicy("policy.example.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.policy = policy
+
+		bans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersBan, u.banUserHandler))))
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
+		adms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersPromote, u.promoteUser))))
+		defer func() {
+			bans.Close()
+			inspects.Close()
+			adms.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		moderator := newUser()
+		moderator.Email = randomNum() + "moderator@mail.com"
+		moderator.Role = "moderator"
+		u.repository.Add(moderator.Email, moderator)
+		moderatorJwt, _ := j.GenearateJWT(moderator)
+
+		superadmin := newSuperadmin()
+		superadminJwt, _ := j.GenearateJWT(superadmin)
+		u.repository.Add(superadmin.Email, superadmin)
+
+		req, err := http.NewRequest(http.MethodPost, bans.URL, prepareParams(t, Params{ // moderator bans user
+			"email":  user.Email,
+			"reason": "test",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+moderatorJwt,
+		)
+
+		resp := doRequest(req, err)
+
+		assertResponse(t, http.StatusOK, "user "+user.Email+" is banned now", resp)
+
+		req, err = http.NewRequest(http.MethodGet, inspects.URL+"?email="+user.Email, nil) // moderator can not inspect
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+moderatorJwt,
+		)
+
+		resp = doRequest(req, err)
+
+		assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+		req, err = http.NewRequest(http.MethodPost, adms.URL, prepareParams(t, Params{ // superadmin promotes moderator to admin
+			"email": moderator.Email,
+			"role":  "admin",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+
+		resp = doRequest(req, err)
+
+		assertResponse(t, http.StatusOK, "user "+moderator.Email+" is admin now", resp)
+
+		req, err = http.NewRequest(http.MethodPost, adms.URL, prepareParams(t, Params{ // unknown role
+			"email": user.Email,
+			"role":  "baker",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+
+		resp = doRequest(req, err)
+
+		assertResponse(t, 401, "not enough rights to performe this action", resp)
+	})
+
 	t.Run("add superadmin test", func(t *testing.T) {
 
 		u := newTestUserService()
 
-		assertEmail := "Undefined superadmin email"
-		assertPassword := "Undefined superadmin password"
+		assertEmail := "undefined superadmin email"
+		assertPassword := "undefined superadmin password"
+		assertWeak := "superadmin password too short"
 		email := "superadmin@openware.com"
-		password := "12345678"
+		password := "Sup3rSecretCake"
+
+		os.Unsetenv("CAKE_ADMIN_EMAIL")
+		os.Unsetenv("CAKE_ADMIN_PASSWORD")
 
-		err := u.addSuperadmin()
-		if err.Error() != assertEmail {
-			t.Errorf("Expected %s but get %s", assertEmail, err.Error())
+		addSuperadmin := func() error {
+			cfg, _, err := config.Load("test", nil, config.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return u.addSuperadmin(cfg.Superadmin)
 		}
 
-		os.Setenv("CAKE_ADMIN_EMAIL", email)
-		err = u.addSuperadmin()
-		if err.Error() != assertPassword {
-			t.Errorf("Expected %s but get %s", assertEmail, err.Error())
+		err := addSuperadmin()
+		if err == nil || err.Error() != assertEmail {
+			t.Errorf("Expected %s but get %v", assertEmail, err)
 		}
 
-		os.Setenv("CAKE_ADMIN_PASSWORD", password)
-		err = u.addSuperadmin()
+		t.Setenv("CAKE_ADMIN_EMAIL", email)
+		err = addSuperadmin()
+		if err == nil || err.Error() != assertPassword {
+			t.Errorf("Expected %s but get %v", assertPassword, err)
+		}
+
+		t.Setenv("CAKE_ADMIN_PASSWORD", "12345678")
+		err = addSuperadmin()
+		if err == nil || err.Error() != assertWeak {
+			t.Errorf("Expected %s but get %v", assertWeak, err)
+		}
+
+		secret := filepath.Join(t.TempDir(), "admin_password")
+		os.WriteFile(secret, []byte(password+"\n"), 0600)
+		t.Setenv("CAKE_ADMIN_PASSWORD_FILE", secret)
+		err = addSuperadmin()
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+
+		superadmin, err := u.repository.Get(email)
 		if err != nil {
 			t.Errorf(err.Error())
 		}
+		if superadmin.Role != superadminRole || !superadmin.MustChangePassword ||
+			superadmin.PasswordDigest != encrypt(password) {
+			t.Errorf("Unexpected superadmin %v", superadmin)
+		}
 
-		_, err = u.repository.Get(email)
+		err = addSuperadmin() // bootstrap is idempotent
 		if err != nil {
 			t.Errorf(err.Error())
 		}
+	})
+
+	t.Run("superadmin favorite cake comes from the catalog", func(t *testing.T) {
+		u := newTestUserService()
+		u.cakes = NewInMemoryCakeStorage()
+		u.cakes.Add(Cake{ID: "pavlova", Name: "pavlova"})
+		u.cakes.Add(Cake{ID: "medovik", Name: "medovik"})
+
+		err := u.addSuperadmin(config.SuperadminConfig{Email: "superadmin@openware.com", Password: "Sup3rSecretCake"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		superadmin, _ := u.repository.Get("superadmin@openware.com")
+		if superadmin.FavoriteCakeID != "medovik" || strings.Join(favoriteCakes(superadmin), " ") != "medovik" {
+			t.Errorf("Unexpected favorite cakes of superadmin %v", superadmin)
+		}
+	})
+
+	t.Run("superadmin must change password on first login", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
+		upds := httptest.NewServer(http.HandlerFunc(j.JWTAuthForPasswordChange(u.repository, u.UpdatePasswordHandler)))
+		defer func() {
+			inspects.Close()
+			upds.Close()
+		}()
+
+		superadmin := newSuperadmin()
+		superadmin.PasswordDigest = encrypt("Sup3rSecretCake")
+		superadmin.MustChangePassword = true
+		superadminJwt, _ := j.GenearateJWT(superadmin)
+		u.repository.Add(superadmin.Email, superadmin)
+
+		req, err := http.NewRequest(http.MethodGet, inspects.URL+"?email="+superadmin.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+
+		resp := doRequest(req, err)
+
+		assertResponse(t, 401, "password change required", resp)
+
+		req, err = http.NewRequest(http.MethodPost, upds.URL, prepareParams(t, Params{
+			"password": "Sup3rSecretCake",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+
+		resp = doRequest(req, err)
+
+		assertResponse(t, 422, "new password must differ from the current one", resp)
+
+		req, err = http.NewRequest(http.MethodPost, upds.URL, prepareParams(t, Params{
+			"password": "Fr3shCakeRecipe",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+
+		resp = doRequest(req, err)
+
+		assertResponse(t, http.StatusOK, "password changed", resp)
+
+		req, err = http.NewRequest(http.MethodGet, inspects.URL+"?email="+superadmin.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+
+		resp = doRequest(req, err)
 
+		assertResponse(t, http.StatusOK, "user "+superadmin.Email+" does not have any bans", resp)
 	})
 }
@@ -2,14 +2,19 @@ package main
 
 import (
 	"log"
-	"os"
 
+	"github.com/Hudanov/Cake-REST-API/config"
 	"github.com/streadway/amqp"
 )
 
-func runPublisher(send chan []byte) {
-	amqpPath := os.Getenv("RABBITMQ_CONN_PATH")
-	conn, err := amqp.Dial(amqpPath)
+// userEvent addresses a message to the websocket clients of one user only;
+// the hub delivers it without the "@email " prefix.
+func userEvent(email, event string) []byte {
+	return []byte("@" + email + " " + event)
+}
+
+func runPublisher(send chan []byte, cfg config.AMQPConfig) {
+	conn, err := amqp.Dial(cfg.URL.Value())
 	if err != nil {
 		log.Fatalf("Failed to connect to RabbitMQ: %s", err)
 	}
@@ -22,7 +27,7 @@ func runPublisher(send chan []byte) {
 	defer ch.Close()
 
 	q, err := ch.QueueDeclare(
-		"default",
+		cfg.Queue,
 		false,
 		false,
 		false,
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+)
+
+const (
+	apiKeyPrefix        = "cake_"
+	apiKeyNameMaxLength = 64
+)
+
+type APIKey struct {
+	ID        string
+	Name      string
+	Owner     string
+	Digest    string
+	Scopes    []Permission
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+func (k APIKey) HasScope(perm Permission) bool {
+	for _, scope := range k.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (k APIKey) Expired(now time.Time) bool {
+	return now.UnixNano() >= k.ExpiresAt
+}
+
+type APIKeyRepository interface {
+	Add(APIKey) error
+	Get(id string) (APIKey, error)
+	List(owner string) []APIKey
+	Delete(id string) error
+}
+
+type InMemoryAPIKeyStorage struct {
+	lock sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewInMemoryAPIKeyStorage() *InMemoryAPIKeyStorage {
+	return &InMemoryAPIKeyStorage{
+		keys: make(map[string]APIKey),
+	}
+}
+
+func (s *InMemoryAPIKeyStorage) Add(key APIKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.keys[key.ID]; ok {
+		return errors.New("api key with such id already exists")
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *InMemoryAPIKeyStorage) Get(id string) (APIKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, errors.New("api key not found")
+	}
+	return key, nil
+}
+
+func (s *InMemoryAPIKeyStorage) List(owner string) []APIKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range s.keys {
+		if key.Owner == owner {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+	return keys
+}
+
+func (s *InMemoryAPIKeyStorage) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.keys[id]; !ok {
+		return errors.New("api key not found")
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+type apiKeyContextKey struct{}
+
+func withAPIKey(ctx context.Context, key APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// apiKeyFromContext reports the key a request was authenticated with, if it
+// was not a JWT.
+func apiKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(APIKey)
+	return key, ok
+}
+
+// lookupAPIKey resolves a "cake_<id>.<secret>" bearer token. Only the digest
+// of the secret is stored, so a leaked repository can't be replayed.
+func lookupAPIKey(keys APIKeyRepository, token string, now time.Time) (APIKey, error) {
+	invalid := errors.New("invalid api key")
+	if keys == nil {
+		return APIKey{}, invalid
+	}
+
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), ".")
+	if !ok {
+		return APIKey{}, invalid
+	}
+
+	key, err := keys.Get(id)
+	if err != nil || !hmac.Equal([]byte(key.Digest), []byte(hashToken(secret))) || key.Expired(now) {
+		return APIKey{}, invalid
+	}
+	return key, nil
+}
+
+// moveAPIKeys hands the keys of a renamed account over to its new email, so
+// whoever registers the old address later can't use them.
+func (s *UserService) moveAPIKeys(from, to string) error {
+	for _, key := range s.apiKeys.List(from) {
+		if err := s.apiKeys.Delete(key.ID); err != nil {
+			return err
+		}
+		key.Owner = to
+		if err := s.apiKeys.Add(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type APIKeyParams struct {
+	ID     string          `json:"id"`
+	Name   string          `json:"name"`
+	Scopes []Permission    `json:"scopes"`
+	TTL    config.Duration `json:"ttl"`
+}
+
+func (s *UserService) validateAPIKeyParams(u User, params *APIKeyParams) error {
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > apiKeyNameMaxLength {
+		return errors.New("api key name must be between 1 and 64 characters")
+	}
+
+	if len(params.Scopes) == 0 {
+		return errors.New("api key must have at least one scope")
+	}
+	for _, scope := range params.Scopes {
+		if scope == permAccount || !s.policy.Can(u.Role, scope) {
+			return errors.New("scope " + string(scope) + " is not allowed for role " + u.Role.String())
+		}
+	}
+
+	if params.TTL == 0 {
+		params.TTL = s.apiKeysCfg.DefaultTTL
+	}
+	if params.TTL < 0 || params.TTL > s.apiKeysCfg.MaxTTL {
+		return errors.New("api key ttl must be positive and not exceed " + s.apiKeysCfg.MaxTTL.String())
+	}
+
+	if len(s.apiKeys.List(u.Email)) >= s.apiKeysCfg.MaxPerUser {
+		return errors.New("too many api keys, revoke unused ones first")
+	}
+	return nil
+}
+
+func (s *UserService) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &APIKeyParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if err := s.validateAPIKeyParams(u, params); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	id, err := randomToken(9)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	now := time.Now()
+	key := APIKey{
+		ID:        id,
+		Name:      params.Name,
+		Owner:     u.Email,
+		Digest:    hashToken(secret),
+		Scopes:    params.Scopes,
+		CreatedAt: now.UnixNano(),
+		ExpiresAt: now.Add(time.Duration(params.TTL)).UnixNano(),
+	}
+	if err := s.apiKeys.Add(key); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, apiKeyPrefix+id+"."+secret)
+	s.notifier <- []byte("api key created: " + u.Email + " " + key.Name)
+}
+
+func (s *UserService) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request, u User) {
+	now := time.Now()
+
+	lines := []string{}
+	for _, key := range s.apiKeys.List(u.Email) {
+		scopes := make([]string, len(key.Scopes))
+		for i, scope := range key.Scopes {
+			scopes[i] = string(scope)
+		}
+
+		status := "expires " + time.Unix(0, key.ExpiresAt).UTC().Format(time.RFC3339)
+		if key.Expired(now) {
+			status = "expired"
+		}
+
+		lines = append(lines, key.ID+" "+key.Name+" ["+strings.Join(scopes, ",")+"] "+status)
+	}
+
+	if len(lines) == 0 {
+		writeResponse(w, http.StatusOK, "user "+u.Email+" does not have any api keys")
+		return
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+func (s *UserService) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &APIKeyParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	key, err := s.apiKeys.Get(params.ID)
+	if err != nil || key.Owner != u.Email {
+		handleError(errors.New("api key not found"), w)
+		return
+	}
+
+	if err := s.apiKeys.Delete(key.ID); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "api key "+key.ID+" revoked")
+	s.notifier <- []byte("api key revoked: " + u.Email + " " + key.Name)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsers_APIKeys(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("scoped api key", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.apiKeys = u.apiKeys
+
+		keys := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.CreateAPIKeyHandler))))
+		lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.ListAPIKeysHandler))))
+		revokes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.RevokeAPIKeyHandler))))
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
+		bans := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersBan, u.banUserHandler))))
+		defer func() {
+			keys.Close()
+			lists.Close()
+			revokes.Close()
+			inspects.Close()
+			bans.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		admin := newAdmin()
+		adminJwt, _ := j.GenearateJWT(admin)
+		u.repository.Add(admin.Email, admin)
+
+		create := func(params Params) parsedResponse {
+			req, err := http.NewRequest(http.MethodPost, keys.URL, prepareParams(t, params))
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+adminJwt,
+			)
+			return doRequest(req, err)
+		}
+
+		resp := create(Params{"name": "ci", "scopes": []string{"users.promote"}})
+		assertResponse(t, 422, "scope users.promote is not allowed for role admin", resp)
+
+		resp = create(Params{"name": "ci", "scopes": []string{"account.manage"}})
+		assertResponse(t, 422, "scope account.manage is not allowed for role admin", resp)
+
+		resp = create(Params{"name": "ci", "scopes": []string{"users.inspect"}, "ttl": "87600h"})
+		assertResponse(t, 422, "api key ttl must be positive and not exceed 8760h0m0s", resp)
+
+		resp = create(Params{"name": "ci", "scopes": []string{"users.inspect"}})
+		assertStatus(t, http.StatusCreated, resp)
+
+		apiKey := string(resp.body)
+		if !strings.HasPrefix(apiKey, apiKeyPrefix) {
+			t.Fatalf("Unexpected api key %s", apiKey)
+		}
+
+		stored := u.apiKeys.List(admin.Email)
+		if len(stored) != 1 || strings.Contains(apiKey, stored[0].Digest) {
+			t.Errorf("Api key must be stored hashed")
+		}
+
+		if msg := string(<-u.notifier); msg != "api key created: "+admin.Email+" ci" {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		withKey := func(method, url string, params Params) parsedResponse {
+			req, err := http.NewRequest(method, url, prepareParams(t, params))
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+apiKey,
+			)
+			return doRequest(req, err)
+		}
+
+		resp = withKey(http.MethodGet, inspects.URL+"?email="+user.Email, nil)
+		assertResponse(t, http.StatusOK, "user "+user.Email+" does not have any bans", resp)
+
+		resp = withKey(http.MethodPost, bans.URL, Params{"email": user.Email, "reason": "spam"})
+		assertResponse(t, 401, "api key is not scoped to users.ban", resp)
+
+		resp = withKey(http.MethodPost, keys.URL, Params{"name": "more", "scopes": []string{"users.inspect"}})
+		assertResponse(t, 401, "api key is not scoped to account.manage", resp)
+
+		req, err := http.NewRequest(http.MethodGet, lists.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+		if !strings.HasPrefix(string(resp.body), stored[0].ID+" ci [users.inspect] expires ") {
+			t.Errorf("Unexpected api key list %s", resp.body)
+		}
+
+		req, err = http.NewRequest(http.MethodPost, revokes.URL, prepareParams(t, Params{
+			"id": stored[0].ID,
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "api key "+stored[0].ID+" revoked", resp)
+
+		resp = withKey(http.MethodGet, inspects.URL+"?email="+user.Email, nil)
+		assertResponse(t, 401, "unauthorized", resp)
+	})
+
+	t.Run("expired and foreign api keys", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.apiKeys = u.apiKeys
+
+		cks := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.getCakeHandler))))
+		revokes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.RevokeAPIKeyHandler))))
+		defer func() {
+			cks.Close()
+			revokes.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		other := newUser()
+		otherJwt, _ := j.GenearateJWT(other)
+		u.repository.Add(other.Email, other)
+
+		u.apiKeys.Add(APIKey{
+			ID:        "expired",
+			Owner:     user.Email,
+			Digest:    hashToken("secret"),
+			Scopes:    []Permission{permProfileRead},
+			ExpiresAt: time.Now().Add(-time.Minute).UnixNano(),
+		})
+		u.apiKeys.Add(APIKey{
+			ID:        "valid",
+			Owner:     user.Email,
+			Digest:    hashToken("secret"),
+			Scopes:    []Permission{permProfileRead},
+			ExpiresAt: time.Now().Add(time.Hour).UnixNano(),
+		})
+
+		for key, status := range map[string]int{
+			apiKeyPrefix + "expired.secret": 401,
+			apiKeyPrefix + "valid.wrong":    401,
+			apiKeyPrefix + "valid.secret":   http.StatusOK,
+		} {
+			req, err := http.NewRequest(http.MethodGet, cks.URL, nil)
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+key,
+			)
+			assertStatus(t, status, doRequest(req, err))
+		}
+
+		req, err := http.NewRequest(http.MethodPost, revokes.URL, prepareParams(t, Params{
+			"id": "valid",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+otherJwt,
+		)
+		resp := doRequest(req, err)
+		assertResponse(t, 422, "api key not found", resp)
+	})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// The service image has no zoneinfo of its own.
+	_ "time/tzdata"
+)
+
+const (
+	birthdaysDays    = 30
+	birthdaysMaxDays = 366
+)
+
+// parseBirthday accepts a full date or just its month and day, and returns
+// the birthday as "MM-DD".
+func parseBirthday(birthday string) (string, error) {
+	invalid := errors.New("birthday must be YYYY-MM-DD or MM-DD")
+
+	date, err := time.Parse("2006-01-02", birthday)
+	if err != nil {
+		// A leap year, so that 02-29 parses.
+		date, err = time.Parse("2006-01-02", "2000-"+birthday)
+		if err != nil {
+			return "", invalid
+		}
+	}
+	if date.Year() < 1900 || date.After(time.Now()) {
+		return "", invalid
+	}
+	return date.Format("01-02"), nil
+}
+
+func parseTimezone(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	if timezone == "Local" {
+		return nil, errors.New("unknown timezone " + timezone)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, errors.New("unknown timezone " + timezone)
+	}
+	return loc, nil
+}
+
+// birthdayIn returns the date of a "MM-DD" birthday in the given year;
+// those born on February 29 celebrate on the 28th in other years.
+func birthdayIn(birthday string, year int, loc *time.Location) time.Time {
+	month, _ := strconv.Atoi(birthday[:2])
+	day, _ := strconv.Atoi(birthday[3:])
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
+	if date.Day() != day {
+		date = time.Date(year, time.Month(month), day-1, 0, 0, 0, 0, loc)
+	}
+	return date
+}
+
+// localToday is the start of the day it is at now in the timezone of a user.
+func localToday(u User, now time.Time) time.Time {
+	loc, err := parseTimezone(u.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+}
+
+// nextBirthday is the first birthday of a user on or after their local day.
+func nextBirthday(u User, now time.Time) time.Time {
+	today := localToday(u, now)
+	date := birthdayIn(u.Birthday, today.Year(), today.Location())
+	if date.Before(today) {
+		date = birthdayIn(u.Birthday, today.Year()+1, today.Location())
+	}
+	return date
+}
+
+// celebrateBirthdays sends the birthday event to every user whose local day
+// is their birthday. The birthdays log keeps the year of the last event, so
+// later checks on the same day, after a restart too, do not send it again.
+func (s *UserService) celebrateBirthdays() int {
+	now := s.clock()
+	sent := 0
+	for _, user := range s.repository.List() {
+		if user.Birthday == "" || UserHasBan(user) {
+			continue
+		}
+
+		next := nextBirthday(user, now)
+		if !next.Equal(localToday(user, now)) {
+			continue
+		}
+
+		first, err := s.birthdays.Mark(user.Email, next.Year())
+		if err != nil {
+			log.Printf("Failed to record birthday of %s: %s", user.Email, err)
+			continue
+		}
+		if !first {
+			continue
+		}
+		s.notifier <- userEvent(user.Email, "birthday: "+s.cakeName(user.FavoriteCakeID))
+		sent++
+	}
+	return sent
+}
+
+// BirthdayLog records the year in which the birthday of each email was last
+// celebrated.
+type BirthdayLog interface {
+	// Mark records the year unless it is recorded already, and tells
+	// whether it was.
+	Mark(email string, year int) (bool, error)
+	Move(from, to string) error
+}
+
+type InMemoryBirthdayLog struct {
+	lock  sync.Mutex
+	years map[string]int
+}
+
+func NewInMemoryBirthdayLog() *InMemoryBirthdayLog {
+	return &InMemoryBirthdayLog{
+		years: make(map[string]int),
+	}
+}
+
+func (l *InMemoryBirthdayLog) Mark(email string, year int) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.years[email] == year {
+		return false, nil
+	}
+	l.years[email] = year
+	return true, nil
+}
+
+func (l *InMemoryBirthdayLog) Move(from, to string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if year, ok := l.years[from]; ok {
+		l.years[to] = year
+		delete(l.years, from)
+	}
+	return nil
+}
+
+// FileBirthdayLog appends every change as an "email year" line to a file and
+// replays it on start, the last line of an email winning.
+type FileBirthdayLog struct {
+	lock  sync.Mutex
+	path  string
+	years map[string]int
+}
+
+func NewFileBirthdayLog(path string) (*FileBirthdayLog, error) {
+	l := &FileBirthdayLog{path: path, years: make(map[string]int)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		year, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		if year == 0 {
+			delete(l.years, fields[0])
+		} else {
+			l.years[fields[0]] = year
+		}
+	}
+	return l, nil
+}
+
+func (l *FileBirthdayLog) Mark(email string, year int) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.years[email] == year {
+		return false, nil
+	}
+	if err := l.append(email + " " + strconv.Itoa(year) + "\n"); err != nil {
+		return false, err
+	}
+	l.years[email] = year
+	return true, nil
+}
+
+func (l *FileBirthdayLog) Move(from, to string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	year, ok := l.years[from]
+	if !ok {
+		return nil
+	}
+	if err := l.append(to + " " + strconv.Itoa(year) + "\n" + from + " 0\n"); err != nil {
+		return err
+	}
+	l.years[to] = year
+	delete(l.years, from)
+	return nil
+}
+
+func (l *FileBirthdayLog) append(lines string) error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(lines)
+	return err
+}
+
+func (s *UserService) runBirthdays(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if sent := s.celebrateBirthdays(); sent > 0 {
+			log.Printf("Sent %d birthday reminders", sent)
+		}
+		<-ticker.C
+	}
+}
+
+type BirthdayParams struct {
+	Birthday string `json:"birthday"`
+	Timezone string `json:"timezone"`
+}
+
+// UpdateBirthdayHandler stores the birthday of a user; an empty birthday
+// removes it.
+func (s *UserService) UpdateBirthdayHandler(w http.ResponseWriter, r *http.Request, user User) {
+	params := &BirthdayParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	newUser := user
+	newUser.Birthday = ""
+	newUser.Timezone = ""
+	if params.Birthday != "" {
+		newUser.Birthday, err = parseBirthday(params.Birthday)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+		if _, err := parseTimezone(params.Timezone); err != nil {
+			handleError(err, w)
+			return
+		}
+		newUser.Timezone = params.Timezone
+	}
+
+	err = s.repository.Update(newUser.Email, newUser)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if newUser.Birthday == "" {
+		writeResponse(w, http.StatusOK, "birthday removed")
+	} else {
+		writeResponse(w, http.StatusOK, "birthday saved")
+	}
+}
+
+func (s *UserService) upcomingBirthdaysHandler(w http.ResponseWriter, r *http.Request, u User) {
+	days, err := queryInt(r, "days", birthdaysDays, birthdaysMaxDays)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	type upcoming struct {
+		date time.Time
+		user User
+	}
+
+	now := s.clock()
+	birthdays := []upcoming{}
+	for _, user := range s.repository.List() {
+		if user.Birthday == "" {
+			continue
+		}
+		next := nextBirthday(user, now)
+		if next.Before(localToday(user, now).AddDate(0, 0, days)) {
+			birthdays = append(birthdays, upcoming{date: next, user: user})
+		}
+	}
+
+	if len(birthdays) == 0 {
+		writeResponse(w, http.StatusOK, "there are no birthdays in the next "+strconv.Itoa(days)+" days")
+		return
+	}
+
+	sort.Slice(birthdays, func(i, j int) bool {
+		a, b := birthdays[i].date.Format("2006-01-02"), birthdays[j].date.Format("2006-01-02")
+		if a != b {
+			return a < b
+		}
+		return birthdays[i].user.Email < birthdays[j].user.Email
+	})
+
+	lines := []string{"upcoming birthdays in " + strconv.Itoa(days) + " days:"}
+	for _, birthday := range birthdays {
+		lines = append(lines, birthday.date.Format("2006-01-02")+" "+birthday.user.Email+
+			" ("+birthday.date.Location().String()+") "+s.cakeName(birthday.user.FavoriteCakeID))
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBirthdays(t *testing.T) {
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	now := time.Date(2026, time.March, 14, 22, 30, 0, 0, time.UTC)
+	u.clock = func() time.Time { return now }
+
+	upds := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.UpdateBirthdayHandler))))
+	upcoming := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.upcomingBirthdaysHandler))))
+	defer func() {
+		upds.Close()
+		upcoming.Close()
+	}()
+
+	addUser := func(email string) User {
+		user := newUser()
+		user.Email = email
+		u.repository.Add(user.Email, user)
+		return user
+	}
+	kyiv := addUser("kyiv@mail.com")
+	london := addUser("london@mail.com")
+	leap := addUser("leap@mail.com")
+	admin := newAdmin()
+	u.repository.Add(admin.Email, admin)
+
+	send := createSender(t, j)
+
+	resp := send(http.MethodPost, upds.URL, kyiv, Params{"birthday": "1990-13-40"})
+	assertResponse(t, 422, "birthday must be YYYY-MM-DD or MM-DD", resp)
+
+	resp = send(http.MethodPost, upds.URL, kyiv, Params{"birthday": "03-15", "timezone": "Mars/Base"})
+	assertResponse(t, 422, "unknown timezone Mars/Base", resp)
+
+	resp = send(http.MethodPost, upds.URL, kyiv, Params{"birthday": "1990-03-15", "timezone": "Europe/Kyiv"})
+	assertResponse(t, http.StatusOK, "birthday saved", resp)
+	send(http.MethodPost, upds.URL, london, Params{"birthday": "03-15", "timezone": "Europe/London"})
+	send(http.MethodPost, upds.URL, leap, Params{"birthday": "2000-02-29"})
+
+	resp = send(http.MethodGet, upcoming.URL+"?days=7", kyiv, nil)
+	assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+	resp = send(http.MethodGet, upcoming.URL+"?days=7", admin, nil)
+	assertResponse(t, http.StatusOK, "upcoming birthdays in 7 days:\n"+
+		"2026-03-15 kyiv@mail.com (Europe/Kyiv) cheesecake\n"+
+		"2026-03-15 london@mail.com (Europe/London) cheesecake", resp)
+
+	// It is already the 15th in Kyiv, but not yet in London.
+	if sent := u.celebrateBirthdays(); sent != 1 {
+		t.Errorf("Expected 1 birthday but got %d", sent)
+	}
+	expectEvent(t, u, "@kyiv@mail.com birthday: cheesecake")
+
+	if sent := u.celebrateBirthdays(); sent != 0 {
+		t.Errorf("Expected birthday to be celebrated once but got %d more", sent)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if sent := u.celebrateBirthdays(); sent != 1 {
+		t.Errorf("Expected 1 birthday but got %d", sent)
+	}
+	expectEvent(t, u, "@london@mail.com birthday: cheesecake")
+
+	now = time.Date(2027, time.February, 28, 12, 0, 0, 0, time.UTC)
+	if sent := u.celebrateBirthdays(); sent != 1 {
+		t.Errorf("Expected leap day birthday on February 28 but got %d", sent)
+	}
+	<-u.notifier
+
+	resp = send(http.MethodPost, upds.URL, leap, Params{"birthday": ""})
+	assertResponse(t, http.StatusOK, "birthday removed", resp)
+
+	resp = send(http.MethodGet, upcoming.URL+"?days=7", admin, nil)
+	assertResponse(t, http.StatusOK, "there are no birthdays in the next 7 days", resp)
+}
+
+func TestFileBirthdayLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "birthdays.log")
+
+	birthdays, err := NewFileBirthdayLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, err := birthdays.Mark("kyiv@mail.com", 2026); !first || err != nil {
+		t.Fatalf("Expected the first mark to be recorded but got %v, %v", first, err)
+	}
+	birthdays.Mark("london@mail.com", 2026)
+	birthdays.Move("london@mail.com", "uk@mail.com")
+
+	// A restart replays the file.
+	birthdays, err = NewFileBirthdayLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := birthdays.Mark("kyiv@mail.com", 2026); first {
+		t.Errorf("Expected the birthday to stay celebrated after a restart")
+	}
+	if first, _ := birthdays.Mark("uk@mail.com", 2026); first {
+		t.Errorf("Expected the mark to follow a renamed account")
+	}
+	if first, _ := birthdays.Mark("london@mail.com", 2026); !first {
+		t.Errorf("Expected the old email to be released")
+	}
+	if first, _ := birthdays.Mark("kyiv@mail.com", 2027); !first {
+		t.Errorf("Expected the next year to be celebrated")
+	}
+}
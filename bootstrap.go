@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+)
+
+const superadminPasswordMinLength = 12
+
+func (s *UserService) validateSuperadminPassword(email, password string) error {
+	cfg := s.passwords.cfg
+	if cfg.MinLength < superadminPasswordMinLength {
+		cfg.MinLength = superadminPasswordMinLength
+	}
+	if cfg.MaxLength < cfg.MinLength {
+		cfg.MaxLength = cfg.MinLength
+	}
+	cfg.RequireLower = true
+	cfg.RequireUpper = true
+	cfg.RequireDigit = true
+	cfg.RejectCommon = true
+	cfg.RejectEmailLocal = true
+
+	if err := NewPasswordPolicy(cfg).Validate(password, email); err != nil {
+		return errors.New("superadmin " + err.Error())
+	}
+
+	return nil
+}
+
+// superadminCake is the favorite cake of the bootstrapped superadmin:
+// napoleon, or the first cake of a catalog without it.
+func (s *UserService) superadminCake() (Cake, error) {
+	if cake, err := s.resolveCake("napoleon"); err == nil {
+		return cake, nil
+	}
+	cakes := s.cakes.List()
+	if len(cakes) == 0 {
+		return Cake{}, errors.New("cake catalog is empty")
+	}
+	return cakes[0], nil
+}
+
+func (s *UserService) addSuperadmin(cfg config.SuperadminConfig) error {
+	if cfg.Email == "" {
+		return errors.New("undefined superadmin email")
+	}
+
+	superadminPassword := cfg.Password.Value()
+	if superadminPassword == "" {
+		return errors.New("undefined superadmin password")
+	}
+
+	superadminEmail, err := s.normalizeEmail(cfg.Email)
+	if err != nil {
+		return err
+	}
+
+	if existing, err := s.repository.Get(superadminEmail); err == nil {
+		if existing.Role != superadminRole {
+			return errors.New("user " + superadminEmail + " already exists and is not superadmin")
+		}
+		return nil
+	}
+
+	if err := s.validateSuperadminPassword(superadminEmail, superadminPassword); err != nil {
+		return err
+	}
+
+	cake, err := s.superadminCake()
+	if err != nil {
+		return err
+	}
+
+	superadmin := User{
+		Email:              superadminEmail,
+		PasswordDigest:     string(md5.New().Sum([]byte(superadminPassword))),
+		FavoriteCakeID:     cake.ID,
+		Role:               superadminRole,
+		MustChangePassword: true,
+	}
+	setFavoriteCakes(&superadmin, []string{cake.ID})
+
+	if err := s.repository.Add(superadmin.Email, superadmin); err != nil {
+		return err
+	}
+	s.stats.Add(superadmin.FavoriteCakeID)
+	return nil
+}
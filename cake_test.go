@@ -38,6 +38,7 @@ func TestCake(t *testing.T) {
 		}
 
 		doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, regParams))) // register
+		verifyEmail(t, u, "test@mail.com")
 
 		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, jwtParams))) // get jwt
 
@@ -79,6 +80,7 @@ func TestCake(t *testing.T) {
 		}
 
 		doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, regParams)))
+		verifyEmail(t, u, "test@mail.com")
 		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, jwtParams)))
 
 		req, err := http.NewRequest(http.MethodGet, cks.URL, nil)
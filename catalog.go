@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+type Cake struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// Names are the canonical name followed by the aliases, all of which
+// resolve to the cake.
+func (c Cake) Names() []string {
+	return append([]string{c.Name}, c.Aliases...)
+}
+
+func DefaultCakes() []Cake {
+	return []Cake{
+		{ID: "cheesecake", Name: "cheesecake", Description: "Baked cream cheese on a biscuit base", Tags: []string{"baked", "creamy"}},
+		{ID: "napoleon", Name: "napoleon", Aliases: []string{"millefeuille"}, Description: "Puff pastry layered with custard", Tags: []string{"layered", "pastry"}},
+		{ID: "tiramisu", Name: "tiramisu", Aliases: []string{"tiramisù"}, Description: "Coffee-soaked ladyfingers with mascarpone", Tags: []string{"coffee", "nobake"}},
+		{ID: "medovik", Name: "medovik", Aliases: []string{"honeycake"}, Description: "Honey sponge layers with sour cream", Tags: []string{"layered", "honey"}},
+		{ID: "brownie", Name: "brownie", Description: "Dense chocolate squares", Tags: []string{"baked", "chocolate"}},
+		{ID: "pavlova", Name: "pavlova", Description: "Meringue with cream and fruit", Tags: []string{"meringue", "fruit"}},
+		{ID: "strudel", Name: "strudel", Description: "Rolled pastry with apple filling", Tags: []string{"pastry", "fruit"}},
+		{ID: "eclair", Name: "eclair", Aliases: []string{"éclair"}, Description: "Choux pastry filled with cream", Tags: []string{"pastry", "chocolate"}},
+		{ID: "crème-brûlée", Name: "crème brûlée", Aliases: []string{"creme brulee"}, Description: "Custard under a caramelized sugar crust", Tags: []string{"custard"}},
+		{ID: "black-forest", Name: "black forest", Aliases: []string{"schwarzwälder kirschtorte"}, Description: "Chocolate sponge with cherries and cream", Tags: []string{"chocolate", "fruit"}},
+		{ID: "шарлотка", Name: "шарлотка", Aliases: []string{"charlotka"}, Description: "Apple sponge cake", Tags: []string{"baked", "fruit"}},
+	}
+}
+
+func LoadCakes(path string) ([]Cake, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cakes := []Cake{}
+	if err := json.Unmarshal(data, &cakes); err != nil {
+		return nil, err
+	}
+	return cakes, nil
+}
+
+type CakeRepository interface {
+	Add(Cake) error
+	Get(id string) (Cake, error)
+	Find(name string) (Cake, error)
+	List() []Cake
+	Update(Cake) error
+	Delete(id string) error
+}
+
+type InMemoryCakeStorage struct {
+	lock  sync.RWMutex
+	cakes map[string]Cake
+	names map[string]string
+}
+
+func NewInMemoryCakeStorage() *InMemoryCakeStorage {
+	return &InMemoryCakeStorage{
+		cakes: make(map[string]Cake),
+		names: make(map[string]string),
+	}
+}
+
+// cakeKey folds case so that names differing only in case, including
+// letters with several lowercase forms like σ and ς, match.
+func cakeKey(name string) string {
+	name = strings.Join(strings.Fields(norm.NFC.String(name)), " ")
+	return cases.Fold().String(name)
+}
+
+func cakeID(name string) string {
+	return strings.ReplaceAll(cakeKey(name), " ", "-")
+}
+
+// claimNames fails if a name of cake already belongs to another cake.
+func (s *InMemoryCakeStorage) claimNames(cake Cake) error {
+	for _, name := range cake.Names() {
+		if id, ok := s.names[cakeKey(name)]; ok && id != cake.ID {
+			return errors.New("cake name " + name + " is already taken by " + id)
+		}
+	}
+	for _, name := range cake.Names() {
+		s.names[cakeKey(name)] = cake.ID
+	}
+	return nil
+}
+
+func (s *InMemoryCakeStorage) releaseNames(cake Cake) {
+	for _, name := range cake.Names() {
+		delete(s.names, cakeKey(name))
+	}
+}
+
+func (s *InMemoryCakeStorage) Add(cake Cake) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.cakes[cake.ID]; ok {
+		return errors.New("cake " + cake.ID + " already exists")
+	}
+	if err := s.claimNames(cake); err != nil {
+		return err
+	}
+	s.cakes[cake.ID] = cake
+	return nil
+}
+
+func (s *InMemoryCakeStorage) Get(id string) (Cake, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	cake, ok := s.cakes[id]
+	if !ok {
+		return Cake{}, errors.New("cake " + id + " not found")
+	}
+	return cake, nil
+}
+
+func (s *InMemoryCakeStorage) Find(name string) (Cake, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	id, ok := s.names[cakeKey(name)]
+	if !ok {
+		return Cake{}, errors.New("unknown cake " + name)
+	}
+	return s.cakes[id], nil
+}
+
+func (s *InMemoryCakeStorage) List() []Cake {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	cakes := make([]Cake, 0, len(s.cakes))
+	for _, cake := range s.cakes {
+		cakes = append(cakes, cake)
+	}
+	sort.Slice(cakes, func(i, j int) bool { return cakes[i].ID < cakes[j].ID })
+	return cakes
+}
+
+func (s *InMemoryCakeStorage) Update(cake Cake) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.cakes[cake.ID]
+	if !ok {
+		return errors.New("cake " + cake.ID + " not found")
+	}
+
+	s.releaseNames(old)
+	if err := s.claimNames(cake); err != nil {
+		s.claimNames(old)
+		return err
+	}
+	s.cakes[cake.ID] = cake
+	return nil
+}
+
+func (s *InMemoryCakeStorage) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cake, ok := s.cakes[id]
+	if !ok {
+		return errors.New("cake " + id + " not found")
+	}
+	s.releaseNames(cake)
+	delete(s.cakes, id)
+	return nil
+}
+
+// resolveCake validates a favorite cake given by name or alias and returns
+// its catalog entry.
+func (s *UserService) resolveCake(name string) (Cake, error) {
+	name, err := normalizeCake(name)
+	if err != nil {
+		return Cake{}, err
+	}
+	return s.cakes.Find(name)
+}
+
+// cakeName is what users see for a stored cake reference.
+func (s *UserService) cakeName(id string) string {
+	if cake, err := s.cakes.Get(id); err == nil {
+		return cake.Name
+	}
+	return id
+}
+
+func formatCake(cake Cake) string {
+	line := cake.ID + ": " + cake.Name
+	if len(cake.Aliases) > 0 {
+		line += " (also " + strings.Join(cake.Aliases, ", ") + ")"
+	}
+	if len(cake.Tags) > 0 {
+		line += " [" + strings.Join(cake.Tags, ", ") + "]"
+	}
+	if cake.Description != "" {
+		line += " - " + cake.Description
+	}
+	return line
+}
+
+type CakeParams struct {
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+func validateCakeParams(p *CakeParams) error {
+	name, err := normalizeCake(p.Name)
+	if err != nil {
+		return err
+	}
+	p.Name = name
+
+	for i, alias := range p.Aliases {
+		if p.Aliases[i], err = normalizeCake(alias); err != nil {
+			return err
+		}
+	}
+	for i, tag := range p.Tags {
+		if p.Tags[i], err = normalizeCake(tag); err != nil {
+			return errors.New("invalid tag " + tag)
+		}
+	}
+	return nil
+}
+
+func readCakeParams(r *http.Request) (*CakeParams, error) {
+	params := &CakeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return nil, errors.New("could not read params")
+	}
+
+	if err := validateCakeParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (s *UserService) listCakesHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cakes := s.cakes.List()
+	if len(cakes) == 0 {
+		writeResponse(w, http.StatusOK, "the catalog is empty")
+		return
+	}
+
+	lines := make([]string, len(cakes))
+	for i, cake := range cakes {
+		lines[i] = formatCake(cake)
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+func (s *UserService) createCakeHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params, err := readCakeParams(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	cake := Cake{
+		ID:          cakeID(params.Name),
+		Name:        params.Name,
+		Aliases:     params.Aliases,
+		Description: params.Description,
+		Tags:        params.Tags,
+	}
+	if err := s.cakes.Add(cake); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, "cake "+cake.ID+" created")
+	s.notifier <- []byte("cake created: " + cake.ID + " by " + u.Email)
+}
+
+func (s *UserService) updateCakeHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cake, err := s.cakes.Get(mux.Vars(r)["id"])
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	params, err := readCakeParams(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	cake.Name = params.Name
+	cake.Aliases = params.Aliases
+	cake.Description = params.Description
+	cake.Tags = params.Tags
+	if err := s.cakes.Update(cake); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "cake "+cake.ID+" updated")
+	s.notifier <- []byte("cake updated: " + cake.ID + " by " + u.Email)
+}
+
+// cakeInUse tells whether orders, gifts, reviews or the favorite history of
+// some user still point to a cake, which would be left naming nothing if it
+// were deleted.
+func (s *UserService) cakeInUse(cakeID string) error {
+	for _, order := range s.orders.List() {
+		if order.CakeID == cakeID {
+			return errors.New("cake " + cakeID + " has orders")
+		}
+	}
+	for _, gift := range s.gifts.List() {
+		if gift.CakeID == cakeID {
+			return errors.New("cake " + cakeID + " has been sent as a gift")
+		}
+	}
+	if len(s.reviews.List(cakeID)) > 0 {
+		return errors.New("cake " + cakeID + " has reviews")
+	}
+	for _, user := range s.repository.List() {
+		if user.CakeHistory == nil {
+			continue
+		}
+		for _, id := range *user.CakeHistory {
+			if id == cakeID {
+				return errors.New("cake " + cakeID + " is in the favorite history of users")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *UserService) deleteCakeHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cake, err := s.cakes.Get(mux.Vars(r)["id"])
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	fans := 0
+	for _, user := range s.repository.List() {
+		if isFavoriteCake(user, cake.ID) {
+			fans++
+		}
+	}
+	if fans > 0 {
+		handleError(errors.New("cake "+cake.ID+" is a favorite of "+strconv.Itoa(fans)+" users"), w)
+		return
+	}
+	if err := s.cakeInUse(cake.ID); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err := s.cakes.Delete(cake.ID); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	// The recipe belongs to the cake alone, so it goes with it; the admin is
+	// told, as its versions can't be brought back.
+	response := "cake " + cake.ID + " deleted"
+	if versions := len(s.recipes.History(cake.ID)); versions > 0 {
+		s.recipes.Delete(cake.ID)
+		response += " with its recipe history of " + strconv.Itoa(versions) + " versions"
+	}
+
+	writeResponse(w, http.StatusOK, response)
+	s.notifier <- []byte("cake deleted: " + cake.ID + " by " + u.Email)
+}
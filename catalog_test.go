@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("favorite cake is resolved against the catalog", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		regs := httptest.NewServer(http.HandlerFunc(u.Register))
+		cks := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.getCakeHandler)))
+		upds := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.UpdateFavoriteCakeHandler)))
+		defer func() {
+			regs.Close()
+			cks.Close()
+			upds.Close()
+		}()
+
+		register := func(cake string) parsedResponse {
+			return doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+				"email":         "test@mail.com",
+				"password":      "somepass",
+				"favorite_cake": cake,
+			})))
+		}
+
+		resp := register("cheesecak")
+		assertResponse(t, 422, "unknown cake cheesecak", resp)
+
+		resp = register("Millefeuille")
+		assertResponse(t, http.StatusCreated, "registered", resp)
+
+		user, _ := u.repository.Get("test@mail.com")
+		if user.FavoriteCakeID != "napoleon" {
+			t.Errorf("Expected napoleon reference but got %s", user.FavoriteCakeID)
+		}
+
+		userJwt, _ := j.GenearateJWT(user)
+		req, err := http.NewRequest(http.MethodPost, upds.URL, prepareParams(t, Params{
+			"favorite_cake": "HoneyCake",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "favorite cake changed", resp)
+
+		req, err = http.NewRequest(http.MethodGet, cks.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "medovik", resp)
+	})
+
+	t.Run("admins manage the catalog", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		creates := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permCakesManage, u.createCakeHandler))))
+		updates := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permCakesManage, u.updateCakeHandler))))
+		deletes := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permCakesManage, u.deleteCakeHandler))))
+		lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.listCakesHandler))))
+		defer func() {
+			creates.Close()
+			updates.Close()
+			deletes.Close()
+			lists.Close()
+		}()
+
+		user := newUser()
+		userJwt, _ := j.GenearateJWT(user)
+		u.repository.Add(user.Email, user)
+
+		admin := newAdmin()
+		adminJwt, _ := j.GenearateJWT(admin)
+		u.repository.Add(admin.Email, admin)
+
+		send := func(method, url, jwt string, params Params) parsedResponse {
+			req, err := http.NewRequest(method, url, prepareParams(t, params))
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+jwt,
+			)
+			return doRequest(req, err)
+		}
+
+		cake := Params{
+			"name":        "Sachertorte",
+			"aliases":     []string{"sacher"},
+			"description": "Chocolate cake with apricot jam",
+			"tags":        []string{"chocolate"},
+		}
+
+		resp := send(http.MethodPost, creates.URL, userJwt, cake)
+		assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+		resp = send(http.MethodPost, creates.URL, adminJwt, cake)
+		assertResponse(t, http.StatusCreated, "cake sachertorte created", resp)
+		if msg := string(<-u.notifier); msg != "cake created: sachertorte by "+admin.Email {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		resp = send(http.MethodPost, creates.URL, adminJwt, Params{"name": "torte", "aliases": []string{"Cheesecake"}})
+		assertResponse(t, 422, "cake name Cheesecake is already taken by cheesecake", resp)
+
+		resp = send(http.MethodPut, updates.URL+"/sachertorte", adminJwt, Params{
+			"name":    "Sachertorte",
+			"aliases": []string{"sacher", "sachercake"},
+		})
+		assertResponse(t, http.StatusOK, "cake sachertorte updated", resp)
+		<-u.notifier
+
+		resp = send(http.MethodGet, lists.URL, userJwt, nil)
+		assertStatus(t, http.StatusOK, resp)
+		if !strings.Contains(string(resp.body), "\nsachertorte: Sachertorte (also sacher, sachercake)\n") {
+			t.Errorf("Unexpected catalog %s", resp.body)
+		}
+
+		resp = send(http.MethodDelete, deletes.URL+"/cheesecake", adminJwt, nil)
+		assertResponse(t, 422, "cake cheesecake is a favorite of 2 users", resp)
+
+		u.orders.Add(Order{Email: user.Email, CakeID: "brownie", Quantity: 1, State: orderDelivered})
+		resp = send(http.MethodDelete, deletes.URL+"/brownie", adminJwt, nil)
+		assertResponse(t, 422, "cake brownie has orders", resp)
+
+		history := []string{"napoleon"}
+		user.CakeHistory = &history
+		u.repository.Update(user.Email, user)
+		resp = send(http.MethodDelete, deletes.URL+"/napoleon", adminJwt, nil)
+		assertResponse(t, 422, "cake napoleon is in the favorite history of users", resp)
+
+		recipe := Recipe{Ingredients: []Ingredient{{Name: "chocolate", Quantity: 200, Unit: "g"}}, Steps: []string{"bake"}, Yield: 12}
+		u.recipes.Add("sachertorte", RecipeRevision{Recipe: recipe, Author: admin.Email})
+		u.recipes.Add("sachertorte", RecipeRevision{Recipe: recipe, Author: admin.Email})
+
+		resp = send(http.MethodDelete, deletes.URL+"/sachertorte", adminJwt, nil)
+		assertResponse(t, http.StatusOK, "cake sachertorte deleted with its recipe history of 2 versions", resp)
+		<-u.notifier
+
+		if revisions := u.recipes.History("sachertorte"); len(revisions) != 0 {
+			t.Errorf("Expected the recipe to be deleted with its cake but got %v", revisions)
+		}
+
+		if _, err := u.cakes.Find("sacher"); err == nil {
+			t.Errorf("Aliases of deleted cake must be released")
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+	"golang.org/x/net/idna"
+)
+
+//go:embed disposable_domains.txt
+var disposableDomainsList string
+
+var disposableDomains = strings.Fields(disposableDomainsList)
+
+const (
+	allowList = "allow"
+	denyList  = "deny"
+)
+
+// DomainPolicy decides which email domains may hold accounts. A pattern is
+// either a domain, matching only itself, or *.domain, matching its
+// subdomains. An explicit deny wins over an explicit allow, which wins over
+// the bundled disposable list; a non-empty allow list rejects the rest.
+type DomainPolicy struct {
+	lock            sync.RWMutex
+	allow           []string
+	deny            []string
+	blockDisposable bool
+}
+
+func NewDomainPolicy(cfg config.DomainsConfig) (*DomainPolicy, error) {
+	p := &DomainPolicy{blockDisposable: cfg.BlockDisposable}
+	for _, pattern := range cfg.Allow {
+		if err := p.Add(allowList, pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range cfg.Deny {
+		if err := p.Add(denyList, pattern); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func normalizeDomainPattern(pattern string) (string, error) {
+	invalid := errors.New("invalid domain pattern " + pattern)
+
+	pattern = strings.TrimSpace(pattern)
+	wildcard := strings.HasPrefix(pattern, "*.")
+	domain, err := idna.Lookup.ToASCII(strings.ToLower(strings.TrimPrefix(pattern, "*.")))
+	if err != nil || domain == "" {
+		return "", invalid
+	}
+
+	// *.tld is fine to deny a whole zone, but a bare domain needs a dot.
+	if wildcard {
+		return "*." + domain, nil
+	}
+	if !strings.Contains(domain, ".") {
+		return "", invalid
+	}
+	return domain, nil
+}
+
+func matchDomain(pattern, domain string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return pattern == domain
+}
+
+func matchAnyDomain(patterns []string, domain string) bool {
+	for _, pattern := range patterns {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDisposableDomain(domain string) bool {
+	for _, disposable := range disposableDomains {
+		if domain == disposable || strings.HasSuffix(domain, "."+disposable) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check expects a normalized email.
+func (p *DomainPolicy) Check(email string) error {
+	domain := email[strings.LastIndex(email, "@")+1:]
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	notAllowed := errors.New("email domain " + domain + " is not allowed")
+	switch {
+	case matchAnyDomain(p.deny, domain):
+		return notAllowed
+	case matchAnyDomain(p.allow, domain):
+		return nil
+	case p.blockDisposable && isDisposableDomain(domain):
+		return errors.New("disposable email addresses are not allowed")
+	case len(p.allow) > 0:
+		return notAllowed
+	}
+	return nil
+}
+
+func (p *DomainPolicy) list(name string) (*[]string, error) {
+	switch name {
+	case allowList:
+		return &p.allow, nil
+	case denyList:
+		return &p.deny, nil
+	}
+	return nil, errors.New("unknown domain list " + name)
+}
+
+func (p *DomainPolicy) Add(name, pattern string) error {
+	pattern, err := normalizeDomainPattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	list, err := p.list(name)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *list {
+		if existing == pattern {
+			return errors.New("domain " + pattern + " is already in " + name + " list")
+		}
+	}
+	*list = append(*list, pattern)
+	sort.Strings(*list)
+	return nil
+}
+
+func (p *DomainPolicy) Remove(name, pattern string) error {
+	pattern, err := normalizeDomainPattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	list, err := p.list(name)
+	if err != nil {
+		return err
+	}
+	for i, existing := range *list {
+		if existing == pattern {
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("domain " + pattern + " is not in " + name + " list")
+}
+
+func (p *DomainPolicy) String() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return "allow: " + strings.Join(p.allow, ", ") + "\n" +
+		"deny: " + strings.Join(p.deny, ", ") + "\n" +
+		"block disposable: " + strconv.FormatBool(p.blockDisposable)
+}
+
+type DomainParams struct {
+	List   string `json:"list"`
+	Domain string `json:"domain"`
+}
+
+func (s *UserService) listDomainsHandler(w http.ResponseWriter, r *http.Request, u User) {
+	writeResponse(w, http.StatusOK, s.domains.String())
+}
+
+func (s *UserService) addDomainHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &DomainParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if err := s.domains.Add(params.List, params.Domain); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "domain "+params.Domain+" added to "+params.List+" list")
+	s.notifier <- []byte("domain policy: " + params.Domain + " added to " + params.List + " list by " + u.Email)
+}
+
+func (s *UserService) removeDomainHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &DomainParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if err := s.domains.Remove(params.List, params.Domain); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "domain "+params.Domain+" removed from "+params.List+" list")
+	s.notifier <- []byte("domain policy: " + params.Domain + " removed from " + params.List + " list by " + u.Email)
+}
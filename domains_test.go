@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+)
+
+func TestDomainPolicy(t *testing.T) {
+	domains, err := NewDomainPolicy(config.DomainsConfig{
+		Allow:           config.List{"partner.com", "*.partner.org", "yopmail.com"},
+		Deny:            config.List{"*.partner.com", "blocked.partner.org"},
+		BlockDisposable: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		email string
+		err   string
+	}{
+		{"bob@partner.com", ""},
+		{"bob@eu.partner.org", ""},
+		{"bob@yopmail.com", ""},
+		{"bob@sales.partner.com", "email domain sales.partner.com is not allowed"},
+		{"bob@blocked.partner.org", "email domain blocked.partner.org is not allowed"},
+		{"bob@partner.org", "email domain partner.org is not allowed"},
+		{"bob@mail.com", "email domain mail.com is not allowed"},
+		{"bob@mailinator.com", "disposable email addresses are not allowed"},
+		{"bob@eu.mailinator.com", "disposable email addresses are not allowed"},
+	} {
+		err := domains.Check(tc.email)
+		if (tc.err == "" && err != nil) || (tc.err != "" && (err == nil || err.Error() != tc.err)) {
+			t.Errorf("Expected %q for %s but got %v", tc.err, tc.email, err)
+		}
+	}
+
+	if _, err := NewDomainPolicy(config.DomainsConfig{Deny: config.List{"*.com"}}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := NewDomainPolicy(config.DomainsConfig{Deny: config.List{"localhost"}}); err == nil {
+		t.Errorf("Expected invalid domain pattern")
+	}
+}
+
+func TestAdmin_Domains(t *testing.T) {
+	doRequest := createRequester(t)
+
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	domains := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permDomainsManage, u.addDomainHandler))))
+	removes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permDomainsManage, u.removeDomainHandler))))
+	lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permDomainsManage, u.listDomainsHandler))))
+	regs := httptest.NewServer(http.HandlerFunc(u.Register))
+	emails := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.UpdateEmailHandler))))
+	defer func() {
+		domains.Close()
+		removes.Close()
+		lists.Close()
+		regs.Close()
+		emails.Close()
+	}()
+
+	admin := newAdmin()
+	adminJwt, _ := j.GenearateJWT(admin)
+	u.repository.Add(admin.Email, admin)
+
+	superadmin := newSuperadmin()
+	superadminJwt, _ := j.GenearateJWT(superadmin)
+	u.repository.Add(superadmin.Email, superadmin)
+
+	user := newUser()
+	userJwt, _ := j.GenearateJWT(user)
+	u.repository.Add(user.Email, user)
+
+	post := func(url, jwt string, params Params) parsedResponse {
+		req, err := http.NewRequest(http.MethodPost, url, prepareParams(t, params))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+jwt,
+		)
+		return doRequest(req, err)
+	}
+
+	register := func(email string) parsedResponse {
+		return doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+			"email":         email,
+			"password":      "somepass",
+			"favorite_cake": "cheesecake",
+		})))
+	}
+
+	resp := register("bob@mailinator.com")
+	assertResponse(t, 422, "disposable email addresses are not allowed", resp)
+
+	resp = post(domains.URL, adminJwt, Params{"list": "allow", "domain": "*.partner.com"})
+	assertResponse(t, 401, "try to acces superadmin api without superadmin rights", resp)
+
+	resp = post(domains.URL, superadminJwt, Params{"list": "allow", "domain": "*.partner.com"})
+	assertResponse(t, http.StatusOK, "domain *.partner.com added to allow list", resp)
+	if msg := string(<-u.notifier); msg != "domain policy: *.partner.com added to allow list by "+superadmin.Email {
+		t.Errorf("Unexpected notification %s", msg)
+	}
+
+	resp = post(domains.URL, superadminJwt, Params{"list": "maybe", "domain": "partner.com"})
+	assertResponse(t, 422, "unknown domain list maybe", resp)
+
+	resp = register("bob@mail.com")
+	assertResponse(t, 422, "email domain mail.com is not allowed", resp)
+
+	resp = register("bob@eu.partner.com")
+	assertResponse(t, http.StatusCreated, "registered", resp)
+
+	resp = post(emails.URL, userJwt, Params{"email": "bob@other.com"})
+	assertResponse(t, 422, "email domain other.com is not allowed", resp)
+
+	req, err := http.NewRequest(http.MethodGet, lists.URL, nil)
+	req.Header.Add(
+		"Authorization",
+		"Bearer "+superadminJwt,
+	)
+	resp = doRequest(req, err)
+	assertResponse(t, http.StatusOK, "allow: *.partner.com\ndeny: \nblock disposable: true", resp)
+
+	resp = post(removes.URL, superadminJwt, Params{"list": "allow", "domain": "*.partner.com"})
+	assertResponse(t, http.StatusOK, "domain *.partner.com removed from allow list", resp)
+
+	resp = post(removes.URL, superadminJwt, Params{"list": "allow", "domain": "*.partner.com"})
+	assertResponse(t, 422, "domain *.partner.com is not in allow list", resp)
+}
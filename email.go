@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeEmail returns the canonical form of email that accounts are keyed
+// by: NFKC, lower case, the domain in its ASCII (punycode) form and, for the
+// domains in foldPlus, without the +tag of the local part.
+func NormalizeEmail(email string, foldPlus []string) (string, error) {
+	invalid := errors.New("invalid email address")
+
+	email = norm.NFKC.String(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "", invalid
+	}
+
+	local := strings.ToLower(email[:at])
+	domain, err := idna.Lookup.ToASCII(strings.ToLower(email[at+1:]))
+	if err != nil {
+		return "", invalid
+	}
+
+	for _, fold := range foldPlus {
+		if strings.EqualFold(fold, domain) {
+			if plus := strings.Index(local, "+"); plus > 0 {
+				local = local[:plus]
+			}
+			break
+		}
+	}
+
+	email = local + "@" + domain
+	if err := validateEmail(email); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+func (s *UserService) normalizeEmail(email string) (string, error) {
+	return NormalizeEmail(email, s.emailCfg.FoldPlusDomains)
+}
+
+// renameAccount moves everything kept under the email of a renamed account
+// to its new one. Sessions are ended rather than moved: their tokens carry
+// the old email and stop resolving to the account anyway.
+func (s *UserService) renameAccount(from, to string) error {
+	if err := s.moveAPIKeys(from, to); err != nil {
+		return err
+	}
+	if err := s.moveReviews(from, to); err != nil {
+		return err
+	}
+	if err := s.moveOrders(from, to); err != nil {
+		return err
+	}
+	if err := s.moveGifts(from, to); err != nil {
+		return err
+	}
+	if err := s.logins.Move(from, to); err != nil {
+		return err
+	}
+	if err := s.birthdays.Move(from, to); err != nil {
+		return err
+	}
+	s.endSessions(from)
+	return nil
+}
+
+// EmailCollision is a group of accounts stored under different emails that
+// normalize to the same one.
+type EmailCollision struct {
+	Email    string
+	Accounts []string
+}
+
+// migrateEmails re-keys accounts stored under a non-canonical email.
+// Colliding accounts can't be merged automatically, so they are left as they
+// are and reported for an admin to resolve. The in-memory store starts empty,
+// so at startup this only has work to do once the users live in a persistent
+// repository; it is run anyway so that such a repository needs no extra step.
+func (s *UserService) migrateEmails() ([]EmailCollision, error) {
+	byEmail := map[string][]User{}
+	for _, user := range s.repository.List() {
+		email, err := s.normalizeEmail(user.Email)
+		if err != nil {
+			email = user.Email
+		}
+		byEmail[email] = append(byEmail[email], user)
+	}
+
+	collisions := []EmailCollision{}
+	for email, users := range byEmail {
+		if len(users) > 1 {
+			collision := EmailCollision{Email: email}
+			for _, user := range users {
+				collision.Accounts = append(collision.Accounts, user.Email)
+			}
+			sort.Strings(collision.Accounts)
+			collisions = append(collisions, collision)
+			continue
+		}
+
+		user := users[0]
+		if user.Email == email {
+			continue
+		}
+
+		old := user.Email
+		user.Email = email
+		if err := s.repository.Add(email, user); err != nil {
+			return nil, err
+		}
+		if _, err := s.repository.Delete(old); err != nil {
+			return nil, err
+		}
+		if err := s.renameAccount(old, email); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].Email < collisions[j].Email })
+	return collisions, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	foldPlus := []string{"gmail.com"}
+
+	for _, tc := range []struct {
+		email    string
+		expected string
+	}{
+		{"bob@mail.com", "bob@mail.com"},
+		{" Bob@Mail.COM ", "bob@mail.com"},
+		{"ｂｏｂ@mail.com", "bob@mail.com"},
+		{"bob@bücher.de", "bob@xn--bcher-kva.de"},
+		{"Bob+cakes@GMail.com", "bob@gmail.com"},
+		{"bob+cakes@mail.com", "bob+cakes@mail.com"},
+	} {
+		email, err := NormalizeEmail(tc.email, foldPlus)
+		if err != nil || email != tc.expected {
+			t.Errorf("Expected %s to normalize to %s but got %s, %v", tc.email, tc.expected, email, err)
+		}
+	}
+
+	for _, email := range []string{"", "bob", "@mail.com", "bob@", "bob@mail"} {
+		if _, err := NormalizeEmail(email, foldPlus); err == nil {
+			t.Errorf("Expected %q to be invalid", email)
+		}
+	}
+}
+
+func TestUsers_EmailIdentity(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("emails differing in case are the same account", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		regs := httptest.NewServer(http.HandlerFunc(u.Register))
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer func() {
+			regs.Close()
+			jwts.Close()
+		}()
+
+		register := func(email string) parsedResponse {
+			return doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+				"email":         email,
+				"password":      "somepass",
+				"favorite_cake": "cheesecake",
+			})))
+		}
+
+		resp := register("Bob@Mail.com")
+		assertResponse(t, http.StatusCreated, "registered", resp)
+		if msg := string(<-u.notifier); msg != "registered: bob@mail.com" {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		resp = register("bob@MAIL.com")
+		assertResponse(t, 422, "Key 'bob@mail.com' already exists", resp)
+
+		verifyEmail(t, u, "bob@mail.com")
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+			"email":    "BOB@mail.com",
+			"password": "somepass",
+		})))
+		assertSessionJWT(t, j, u, "bob@mail.com", resp)
+	})
+
+	t.Run("migration re-keys accounts and reports collisions", func(t *testing.T) {
+		u := newTestUserService()
+
+		for _, email := range []string{"Alice@Mail.com", "bob@mail.com", "Bob@mail.com", "carol@mail.com"} {
+			user := newUser()
+			user.Email = email
+			u.repository.Add(email, user)
+		}
+		u.logins.Add(LoginAttempt{Email: "Alice@Mail.com", IP: "127.0.0.1", Result: loginSuccess})
+		u.sessions.Add(Session{ID: "alice", Email: "Alice@Mail.com"})
+
+		collisions, err := u.migrateEmails()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(collisions) != 1 || collisions[0].Email != "bob@mail.com" ||
+			len(collisions[0].Accounts) != 2 || collisions[0].Accounts[0] != "Bob@mail.com" {
+			t.Errorf("Unexpected collisions %v", collisions)
+		}
+
+		if alice, err := u.repository.Get("alice@mail.com"); err != nil || alice.Email != "alice@mail.com" {
+			t.Errorf("Expected alice to be re-keyed but got %v, %v", alice, err)
+		}
+		if _, err := u.repository.Get("Alice@Mail.com"); err == nil {
+			t.Errorf("Old key must be removed")
+		}
+		if attempts := u.logins.List("alice@mail.com"); len(attempts) != 1 || attempts[0].Email != "alice@mail.com" {
+			t.Errorf("Expected login history to follow the account but got %v", attempts)
+		}
+		if _, err := u.sessions.Get("alice"); err == nil {
+			t.Errorf("Sessions of the old email must be ended")
+		}
+		if _, err := u.repository.Get("Bob@mail.com"); err != nil {
+			t.Errorf("Colliding accounts must be left untouched")
+		}
+	})
+}
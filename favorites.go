@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const favoriteCakesMax = 5
+
+// favoriteCakes returns the ranked favorites of a user. Accounts created
+// before the list existed only have their #1 pick.
+func favoriteCakes(u User) []string {
+	if u.FavoriteCakes != nil && len(*u.FavoriteCakes) > 0 {
+		return append([]string{}, *u.FavoriteCakes...)
+	}
+	if u.FavoriteCakeID == "" {
+		return []string{}
+	}
+	return []string{u.FavoriteCakeID}
+}
+
+// setFavoriteCakes stores a ranked list, keeping FavoriteCakeID as its #1
+// pick. Cakes that dropped out of the list go to the favorite history.
+func setFavoriteCakes(u *User, ids []string) {
+	kept := map[string]bool{}
+	for _, id := range ids {
+		kept[id] = true
+	}
+	for _, id := range favoriteCakes(*u) {
+		if !kept[id] {
+			rememberCake(u, id)
+		}
+	}
+
+	ids = append([]string{}, ids...)
+	u.FavoriteCakes = &ids
+	u.FavoriteCakeID = ids[0]
+}
+
+func isFavoriteCake(u User, cakeID string) bool {
+	for _, id := range favoriteCakes(u) {
+		if id == cakeID {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFavoriteCakes validates a ranked list of cake names and returns
+// their catalog ids in the same order.
+func (s *UserService) resolveFavoriteCakes(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, errors.New("favorite cakes can't be empty")
+	}
+	if len(names) > favoriteCakesMax {
+		return nil, errors.New("at most " + strconv.Itoa(favoriteCakesMax) + " favorite cakes are allowed")
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		cake, err := s.resolveCake(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[cake.ID] {
+			return nil, errors.New("cake " + cake.ID + " is listed twice")
+		}
+		seen[cake.ID] = true
+		ids = append(ids, cake.ID)
+	}
+	return ids, nil
+}
+
+// withTopCake makes cakeID the #1 pick in place of the current one, the way
+// setting the single favorite cake always worked.
+func withTopCake(ids []string, cakeID string) []string {
+	ranked := []string{cakeID}
+	for i, id := range ids {
+		if i > 0 && id != cakeID {
+			ranked = append(ranked, id)
+		}
+	}
+	return ranked
+}
+
+// moveCake moves cakeID to the 1-based rank to.
+func moveCake(ids []string, cakeID string, to int) ([]string, error) {
+	if to < 1 || to > len(ids) {
+		return nil, errors.New("rank must be from 1 to " + strconv.Itoa(len(ids)))
+	}
+
+	rest := []string{}
+	for _, id := range ids {
+		if id != cakeID {
+			rest = append(rest, id)
+		}
+	}
+	if len(rest) == len(ids) {
+		return nil, errors.New("cake " + cakeID + " is not in your favorites")
+	}
+
+	ranked := append([]string{}, rest[:to-1]...)
+	ranked = append(ranked, cakeID)
+	return append(ranked, rest[to-1:]...), nil
+}
+
+func (s *UserService) formatFavoriteCakes(u User) string {
+	lines := []string{}
+	for i, id := range favoriteCakes(u) {
+		lines = append(lines, strconv.Itoa(i+1)+". "+s.cakeName(id))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type FavoriteCakesParams struct {
+	FavoriteCakes []string `json:"favorite_cakes"`
+	Move          string   `json:"move"`
+	To            int      `json:"to"`
+}
+
+// UpdateFavoriteCakesHandler either replaces the whole ranked list or moves
+// one of its cakes to another rank.
+func (s *UserService) UpdateFavoriteCakesHandler(w http.ResponseWriter, r *http.Request, user User) {
+	params := &FavoriteCakesParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	var ids []string
+	if params.Move != "" {
+		var cake Cake
+		cake, err = s.resolveCake(params.Move)
+		if err == nil {
+			ids, err = moveCake(favoriteCakes(user), cake.ID, params.To)
+		}
+	} else {
+		ids, err = s.resolveFavoriteCakes(params.FavoriteCakes)
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	newUser := user
+	setFavoriteCakes(&newUser, ids)
+
+	err = s.repository.Update(newUser.Email, newUser)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	s.stats.Change(user.FavoriteCakeID, newUser.FavoriteCakeID)
+
+	writeResponse(w, http.StatusOK, s.formatFavoriteCakes(newUser))
+	s.notifier <- []byte("updated cake: " + newUser.Email)
+}
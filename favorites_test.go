@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFavoriteCakes(t *testing.T) {
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	cks := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.getCakeHandler)))
+	upd := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.UpdateFavoriteCakeHandler)))
+	upds := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.UpdateFavoriteCakesHandler)))
+	defer func() {
+		cks.Close()
+		upd.Close()
+		upds.Close()
+	}()
+
+	user := newUser()
+	u.repository.Add(user.Email, user)
+	u.stats.Add(user.FavoriteCakeID)
+
+	sendAs := createSender(t, j)
+	send := func(method, url string, params Params) parsedResponse {
+		resp := sendAs(method, url, user, params)
+		if method == http.MethodPost && resp.status == http.StatusOK {
+			<-u.notifier
+		}
+		return resp
+	}
+
+	resp := send(http.MethodGet, cks.URL+"?all=true", nil)
+	assertResponse(t, http.StatusOK, "1. cheesecake", resp)
+
+	resp = send(http.MethodPost, upds.URL, Params{"favorite_cakes": []string{}})
+	assertResponse(t, 422, "favorite cakes can't be empty", resp)
+
+	resp = send(http.MethodPost, upds.URL, Params{"favorite_cakes": []string{"napoleon", "millefeuille"}})
+	assertResponse(t, 422, "cake napoleon is listed twice", resp)
+
+	resp = send(http.MethodPost, upds.URL, Params{"favorite_cakes": []string{"napoleon", "brownie", "tiramisu", "pavlova", "medovik", "cheesecake"}})
+	assertResponse(t, 422, "at most 5 favorite cakes are allowed", resp)
+
+	resp = send(http.MethodPost, upds.URL, Params{"favorite_cakes": []string{"napoleon", "brownie", "tiramisu"}})
+	assertResponse(t, http.StatusOK, "1. napoleon\n2. brownie\n3. tiramisu", resp)
+
+	resp = send(http.MethodGet, cks.URL, nil)
+	assertResponse(t, http.StatusOK, "napoleon", resp)
+
+	resp = send(http.MethodPost, upds.URL, Params{"move": "tiramisu", "to": 1})
+	assertResponse(t, http.StatusOK, "1. tiramisu\n2. napoleon\n3. brownie", resp)
+
+	resp = send(http.MethodPost, upds.URL, Params{"move": "tiramisu", "to": 4})
+	assertResponse(t, 422, "rank must be from 1 to 3", resp)
+
+	resp = send(http.MethodPost, upds.URL, Params{"move": "pavlova", "to": 1})
+	assertResponse(t, 422, "cake pavlova is not in your favorites", resp)
+
+	resp = send(http.MethodPost, upd.URL, Params{"favorite_cake": "brownie"})
+	assertResponse(t, http.StatusOK, "favorite cake changed", resp)
+
+	resp = send(http.MethodGet, cks.URL+"?all=true", nil)
+	assertResponse(t, http.StatusOK, "1. brownie\n2. napoleon", resp)
+
+	user, _ = u.repository.Get(user.Email)
+	if user.FavoriteCakeID != "brownie" {
+		t.Errorf("Expected brownie as the #1 pick but got %s", user.FavoriteCakeID)
+	}
+	if user.CakeHistory == nil || len(*user.CakeHistory) != 2 || (*user.CakeHistory)[0] != "cheesecake" || (*user.CakeHistory)[1] != "tiramisu" {
+		t.Errorf("Expected dropped cakes in history but got %v", user.CakeHistory)
+	}
+
+	top := u.stats.Top(0)
+	if len(top) != 1 || top[0].CakeID != "brownie" || top[0].Count != 1 {
+		t.Errorf("Expected only the #1 pick to count as a fan but got %v", top)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const giftMessageMaxLength = 280
+
+type GiftState string
+
+const (
+	giftPending  GiftState = "pending"
+	giftAccepted GiftState = "accepted"
+	giftDeclined GiftState = "declined"
+)
+
+type Gift struct {
+	ID         int
+	From       string
+	To         string
+	CakeID     string
+	Message    string
+	State      GiftState
+	SentAt     int64
+	AnsweredAt int64
+}
+
+type GiftRepository interface {
+	Add(Gift) (Gift, error)
+	// AddWithinLimit adds a gift unless its sender already sent limit gifts
+	// after since, counting and adding as one step.
+	AddWithinLimit(gift Gift, since int64, limit int) (Gift, error)
+	Get(id int) (Gift, error)
+	Update(Gift) error
+	// Transition moves a gift to a state if check allows it, as one step,
+	// so a gift can't be both accepted and declined.
+	Transition(id int, to GiftState, at int64, check func(Gift) error) (Gift, error)
+	List() []Gift
+	ListBySender(email string) []Gift
+	ListByRecipient(email string) []Gift
+}
+
+type InMemoryGiftStorage struct {
+	lock   sync.RWMutex
+	gifts  map[int]Gift
+	lastID int
+}
+
+func NewInMemoryGiftStorage() *InMemoryGiftStorage {
+	return &InMemoryGiftStorage{
+		gifts: make(map[int]Gift),
+	}
+}
+
+func (s *InMemoryGiftStorage) Add(gift Gift) (Gift, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.add(gift), nil
+}
+
+func (s *InMemoryGiftStorage) AddWithinLimit(gift Gift, since int64, limit int) (Gift, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sent := 0
+	for _, other := range s.gifts {
+		if other.From == gift.From && other.SentAt > since {
+			sent++
+		}
+	}
+	if sent >= limit {
+		return Gift{}, errors.New("you can send at most " + strconv.Itoa(limit) + " gifts a day")
+	}
+	return s.add(gift), nil
+}
+
+func (s *InMemoryGiftStorage) add(gift Gift) Gift {
+	s.lastID++
+	gift.ID = s.lastID
+	s.gifts[gift.ID] = gift
+	return gift
+}
+
+func (s *InMemoryGiftStorage) Get(id int) (Gift, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	gift, ok := s.gifts[id]
+	if !ok {
+		return Gift{}, errors.New("gift " + strconv.Itoa(id) + " not found")
+	}
+	return gift, nil
+}
+
+func (s *InMemoryGiftStorage) Update(gift Gift) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.gifts[gift.ID]; !ok {
+		return errors.New("gift " + strconv.Itoa(gift.ID) + " not found")
+	}
+	s.gifts[gift.ID] = gift
+	return nil
+}
+
+func (s *InMemoryGiftStorage) Transition(id int, to GiftState, at int64, check func(Gift) error) (Gift, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	gift, ok := s.gifts[id]
+	if !ok {
+		return Gift{}, errors.New("gift " + strconv.Itoa(id) + " not found")
+	}
+	if err := check(gift); err != nil {
+		return Gift{}, err
+	}
+	gift.State = to
+	gift.AnsweredAt = at
+	s.gifts[id] = gift
+	return gift, nil
+}
+
+// List returns all gifts, the newest first.
+func (s *InMemoryGiftStorage) List() []Gift {
+	return s.list(func(Gift) bool { return true })
+}
+
+// ListBySender returns the gifts sent by email, the newest first.
+func (s *InMemoryGiftStorage) ListBySender(email string) []Gift {
+	return s.list(func(gift Gift) bool { return gift.From == email })
+}
+
+// ListByRecipient returns the gifts sent to email, the newest first.
+func (s *InMemoryGiftStorage) ListByRecipient(email string) []Gift {
+	return s.list(func(gift Gift) bool { return gift.To == email })
+}
+
+func (s *InMemoryGiftStorage) list(match func(Gift) bool) []Gift {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	gifts := []Gift{}
+	for _, gift := range s.gifts {
+		if match(gift) {
+			gifts = append(gifts, gift)
+		}
+	}
+	sort.Slice(gifts, func(i, j int) bool { return gifts[i].ID > gifts[j].ID })
+	return gifts
+}
+
+// moveGifts keeps the gifts of a renamed account, sent and received,
+// attributed to it.
+func (s *UserService) moveGifts(from, to string) error {
+	gifts := append(s.gifts.ListBySender(from), s.gifts.ListByRecipient(from)...)
+	for _, gift := range gifts {
+		if gift.From == from {
+			gift.From = to
+		}
+		if gift.To == from {
+			gift.To = to
+		}
+		if err := s.gifts.Update(gift); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fromBanned tells whether the sender of a gift is banned now. Such gifts
+// are kept, but the recipient no longer sees them.
+func (s *UserService) fromBanned(gift Gift) bool {
+	sender, err := s.repository.Get(gift.From)
+	return err == nil && UserHasBan(sender)
+}
+
+func (s *UserService) formatGift(gift Gift, who string) string {
+	line := strconv.Itoa(gift.ID) + ": " + s.cakeName(gift.CakeID) + " " + who + " " + string(gift.State)
+	if gift.Message != "" {
+		line += " - " + gift.Message
+	}
+	return line
+}
+
+type GiftParams struct {
+	Email   string `json:"email"`
+	Cake    string `json:"cake"`
+	Message string `json:"message"`
+}
+
+func (s *UserService) sendGiftHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &GiftParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	email, err := s.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if email == u.Email {
+		handleError(errors.New("you can't send a gift to yourself"), w)
+		return
+	}
+
+	recipient, err := s.repository.Get(email)
+	if err != nil || UserHasBan(recipient) {
+		handleError(errors.New("user "+email+" can't receive gifts"), w)
+		return
+	}
+
+	cake, err := s.resolveCake(params.Cake)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	params.Message = strings.TrimSpace(params.Message)
+	if utf8.RuneCountInString(params.Message) > giftMessageMaxLength {
+		handleError(errors.New("message too long"), w)
+		return
+	}
+
+	now := s.clock()
+	gift, err := s.gifts.AddWithinLimit(Gift{
+		From:    u.Email,
+		To:      recipient.Email,
+		CakeID:  cake.ID,
+		Message: params.Message,
+		State:   giftPending,
+		SentAt:  now.UnixNano(),
+	}, now.Add(-24*time.Hour).UnixNano(), s.giftsCfg.DailyLimit)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, "gift "+strconv.Itoa(gift.ID)+" sent to "+gift.To)
+	s.notifier <- userEvent(gift.To, "gift "+strconv.Itoa(gift.ID)+" from "+gift.From+": "+s.cakeName(gift.CakeID))
+}
+
+func (s *UserService) giftInboxHandler(w http.ResponseWriter, r *http.Request, u User) {
+	lines := []string{}
+	for _, gift := range s.gifts.ListByRecipient(u.Email) {
+		if !s.fromBanned(gift) {
+			lines = append(lines, s.formatGift(gift, "from "+gift.From))
+		}
+	}
+	if len(lines) == 0 {
+		writeResponse(w, http.StatusOK, "you have no gifts")
+		return
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+func (s *UserService) giftOutboxHandler(w http.ResponseWriter, r *http.Request, u User) {
+	gifts := s.gifts.ListBySender(u.Email)
+	if len(gifts) == 0 {
+		writeResponse(w, http.StatusOK, "you have not sent any gifts")
+		return
+	}
+
+	lines := make([]string, len(gifts))
+	for i, gift := range gifts {
+		lines[i] = s.formatGift(gift, "to "+gift.To)
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+// answerGift returns a handler with which the recipient of a pending gift
+// accepts or declines it.
+func (s *UserService) answerGift(state GiftState) func(http.ResponseWriter, *http.Request, User) {
+	return func(w http.ResponseWriter, r *http.Request, u User) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			handleError(errors.New("invalid gift id"), w)
+			return
+		}
+
+		gift, err := s.gifts.Transition(id, state, s.clock().UnixNano(), func(gift Gift) error {
+			if gift.To != u.Email || s.fromBanned(gift) {
+				return errors.New("gift " + strconv.Itoa(id) + " not found")
+			}
+			if gift.State != giftPending {
+				return errors.New("gift " + strconv.Itoa(id) + " is already " + string(gift.State))
+			}
+			return nil
+		})
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+
+		writeResponse(w, http.StatusOK, "gift "+strconv.Itoa(id)+" "+string(state))
+		s.notifier <- userEvent(gift.From, "gift "+strconv.Itoa(id)+" "+string(state)+" by "+gift.To)
+	}
+}
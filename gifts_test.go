@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCakeGifts(t *testing.T) {
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	now := time.Now()
+	u.clock = func() time.Time { return now }
+	u.giftsCfg.DailyLimit = 2
+
+	gifts := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.sendGiftHandler))))
+	inboxes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.giftInboxHandler))))
+	outboxes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.giftOutboxHandler))))
+	accepts := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.answerGift(giftAccepted)))))
+	declines := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.answerGift(giftDeclined)))))
+	defer func() {
+		gifts.Close()
+		inboxes.Close()
+		outboxes.Close()
+		accepts.Close()
+		declines.Close()
+	}()
+
+	sender := newUser()
+	u.repository.Add(sender.Email, sender)
+	recipient := newUser()
+	u.repository.Add(recipient.Email, recipient)
+	spammer := newUser()
+	u.repository.Add(spammer.Email, spammer)
+
+	send := createSender(t, j)
+
+	resp := send(http.MethodPost, gifts.URL, sender, Params{"email": sender.Email, "cake": "napoleon"})
+	assertResponse(t, 422, "you can't send a gift to yourself", resp)
+
+	resp = send(http.MethodPost, gifts.URL, sender, Params{"email": "nobody@mail.com", "cake": "napoleon"})
+	assertResponse(t, 422, "user nobody@mail.com can't receive gifts", resp)
+
+	resp = send(http.MethodPost, gifts.URL, sender, Params{"email": recipient.Email, "cake": "Millefeuille", "message": "happy friday"})
+	assertResponse(t, http.StatusCreated, "gift 1 sent to "+recipient.Email, resp)
+	expectEvent(t, u, "@" + recipient.Email + " gift 1 from " + sender.Email + ": napoleon")
+
+	resp = send(http.MethodPost, gifts.URL, sender, Params{"email": recipient.Email, "cake": "brownie"})
+	assertResponse(t, http.StatusCreated, "gift 2 sent to "+recipient.Email, resp)
+	<-u.notifier
+
+	resp = send(http.MethodPost, gifts.URL, sender, Params{"email": recipient.Email, "cake": "pavlova"})
+	assertResponse(t, 422, "you can send at most 2 gifts a day", resp)
+
+	resp = send(http.MethodPost, gifts.URL, spammer, Params{"email": recipient.Email, "cake": "strudel"})
+	assertResponse(t, http.StatusCreated, "gift 3 sent to "+recipient.Email, resp)
+	<-u.notifier
+
+	if err := u.BanUser(spammer.Email, "admin@mail.com", "spam"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = send(http.MethodGet, inboxes.URL, recipient, nil)
+	assertResponse(t, http.StatusOK, "2: brownie from "+sender.Email+" pending\n1: napoleon from "+sender.Email+" pending - happy friday", resp)
+
+	resp = send(http.MethodPost, accepts.URL+"/3", recipient, nil)
+	assertResponse(t, 422, "gift 3 not found", resp)
+
+	resp = send(http.MethodPost, accepts.URL+"/1", sender, nil)
+	assertResponse(t, 422, "gift 1 not found", resp)
+
+	resp = send(http.MethodPost, accepts.URL+"/1", recipient, nil)
+	assertResponse(t, http.StatusOK, "gift 1 accepted", resp)
+	expectEvent(t, u, "@" + sender.Email + " gift 1 accepted by " + recipient.Email)
+
+	resp = send(http.MethodPost, declines.URL+"/1", recipient, nil)
+	assertResponse(t, 422, "gift 1 is already accepted", resp)
+
+	resp = send(http.MethodPost, declines.URL+"/2", recipient, nil)
+	assertResponse(t, http.StatusOK, "gift 2 declined", resp)
+	<-u.notifier
+
+	resp = send(http.MethodGet, outboxes.URL, sender, nil)
+	assertResponse(t, http.StatusOK, "2: brownie to "+recipient.Email+" declined\n1: napoleon to "+recipient.Email+" accepted - happy friday", resp)
+
+	resp = send(http.MethodGet, outboxes.URL, recipient, nil)
+	assertResponse(t, http.StatusOK, "you have not sent any gifts", resp)
+
+	now = now.Add(25 * time.Hour)
+	resp = send(http.MethodPost, gifts.URL, sender, Params{"email": recipient.Email, "cake": "pavlova"})
+	assertResponse(t, http.StatusCreated, "gift 4 sent to "+recipient.Email, resp)
+	<-u.notifier
+}
+
+func TestGiftTransitionIsAtomic(t *testing.T) {
+	gifts := NewInMemoryGiftStorage()
+	gift, _ := gifts.Add(Gift{From: "sender@mail.com", To: "recipient@mail.com", CakeID: "napoleon", State: giftPending})
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	answered := 0
+	for _, state := range []GiftState{giftAccepted, giftDeclined, giftAccepted, giftDeclined} {
+		wg.Add(1)
+		go func(state GiftState) {
+			defer wg.Done()
+			_, err := gifts.Transition(gift.ID, state, time.Now().UnixNano(), func(g Gift) error {
+				if g.State != giftPending {
+					return errors.New("already answered")
+				}
+				return nil
+			})
+			if err == nil {
+				lock.Lock()
+				answered++
+				lock.Unlock()
+			}
+		}(state)
+	}
+	wg.Wait()
+
+	if answered != 1 {
+		t.Errorf("Expected exactly one answer but got %d", answered)
+	}
+}
+
+func TestGiftDailyLimitIsAtomic(t *testing.T) {
+	gifts := NewInMemoryGiftStorage()
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gifts.AddWithinLimit(Gift{From: "sender@mail.com", To: "recipient@mail.com", CakeID: "napoleon", State: giftPending, SentAt: now.UnixNano()},
+				now.Add(-24*time.Hour).UnixNano(), 3)
+		}()
+	}
+	wg.Wait()
+
+	if sent := gifts.ListBySender("sender@mail.com"); len(sent) != 3 {
+		t.Errorf("Expected 3 gifts within the limit but got %d", len(sent))
+	}
+}
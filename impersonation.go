@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AuditEntry struct {
+	At         int64
+	Actor      string
+	OnBehalfOf string
+	Action     string
+	Status     int
+}
+
+type AuditRepository interface {
+	Add(AuditEntry) error
+	List(email string) []AuditEntry
+}
+
+type InMemoryAuditLog struct {
+	lock    sync.RWMutex
+	entries []AuditEntry
+}
+
+func NewInMemoryAuditLog() *InMemoryAuditLog {
+	return &InMemoryAuditLog{}
+}
+
+func (l *InMemoryAuditLog) Add(entry AuditEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// List returns the entries email took part in, either as the actor or as
+// the impersonated user.
+func (l *InMemoryAuditLog) List(email string) []AuditEntry {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	entries := []AuditEntry{}
+	for _, entry := range l.entries {
+		if entry.Actor == email || entry.OnBehalfOf == email {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// impersonatorFromContext reports the superadmin acting through the
+// request's session, if it is an impersonated one.
+func impersonatorFromContext(ctx context.Context) (string, bool) {
+	session, ok := sessionFromContext(ctx)
+	if !ok || session.ImpersonatedBy == "" {
+		return "", false
+	}
+	return session.ImpersonatedBy, true
+}
+
+// audited records every request of an impersonated session together with
+// its outcome, attributed to the actor on behalf of the user.
+func (j *JWTService) audited(actor string, h ProtectedHandler) ProtectedHandler {
+	return func(rw http.ResponseWriter, r *http.Request, u User) {
+		writer := &logWriter{ResponseWriter: rw}
+		h(writer, r, u)
+
+		status := writer.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		entry := AuditEntry{
+			At:         time.Now().UnixNano(),
+			Actor:      actor,
+			OnBehalfOf: u.Email,
+			Action:     r.Method + " " + r.URL.Path,
+			Status:     status,
+		}
+		if j.audit != nil {
+			j.audit.Add(entry)
+		}
+		log.Printf("AUDIT: %s on behalf of %s: %s -> %d", entry.Actor, entry.OnBehalfOf, entry.Action, entry.Status)
+	}
+}
+
+type ImpersonateParams struct {
+	Email string `json:"email"`
+}
+
+func (s *UserService) impersonateHandler(jwtService *JWTService) ProtectedHandler {
+	return func(w http.ResponseWriter, r *http.Request, u User) {
+		params := &ImpersonateParams{}
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			handleError(errors.New("could not read params"), w)
+			return
+		}
+
+		email, err := s.normalizeEmail(params.Email)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+
+		target, err := s.repository.Get(email)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+
+		if !s.validateAdminAction(w, u, target) {
+			return
+		}
+
+		session, err := newSession(r, target.Email)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+
+		session.ImpersonatedBy = u.Email
+		session.ExpiresAt = time.Unix(0, session.CreatedAt).Add(time.Duration(s.impersonationTTL)).UnixNano()
+		if err := s.sessions.Add(session); err != nil {
+			handleError(err, w)
+			return
+		}
+
+		token, err := jwtService.GenerateSessionJWT(target, session)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+
+		s.audit.Add(AuditEntry{
+			At:         session.CreatedAt,
+			Actor:      u.Email,
+			OnBehalfOf: target.Email,
+			Action:     "impersonate",
+			Status:     http.StatusOK,
+		})
+
+		writeResponse(w, http.StatusOK, token)
+		s.notifier <- []byte("impersonation: " + u.Email + " as " + target.Email)
+	}
+}
+
+func (s *UserService) auditHandler(w http.ResponseWriter, r *http.Request, u User) {
+	email, err := s.normalizeEmail(r.URL.Query().Get("email"))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	entries := s.audit.List(email)
+	if len(entries) == 0 {
+		writeResponse(w, http.StatusOK, "user "+email+" does not have any audit entries")
+		return
+	}
+
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = time.Unix(0, entry.At).UTC().Format(time.RFC3339) + " " +
+			entry.Actor + " on behalf of " + entry.OnBehalfOf + ": " +
+			entry.Action + " -> " + strconv.Itoa(entry.Status)
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin_Impersonation(t *testing.T) {
+	doRequest := createRequester(t)
+
+	sessionJwt := func(t *testing.T, u *UserService, j *JWTService, user User) string {
+		session, err := u.startSession(httptest.NewRequest(http.MethodPost, "/", nil), user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _ := j.GenerateSessionJWT(user, session)
+		return token
+	}
+
+	t.Run("superadmin acts on behalf of user", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.sessions = u.sessions
+		j.audit = u.audit
+
+		imps := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersImpersonate, u.impersonateHandler(j)))))
+		audits := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersImpersonate, u.auditHandler))))
+		cks := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.getCakeHandler))))
+		emails := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.UpdateEmailHandler))))
+		defer func() {
+			imps.Close()
+			audits.Close()
+			cks.Close()
+			emails.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		superadmin := newSuperadmin()
+		u.repository.Add(superadmin.Email, superadmin)
+		superadminJwt := sessionJwt(t, u, j, superadmin)
+
+		req, err := http.NewRequest(http.MethodPost, imps.URL, prepareParams(t, Params{
+			"email": user.Email,
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+		resp := doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+		impersonatedJwt := string(resp.body)
+
+		if msg := string(<-u.notifier); msg != "impersonation: "+superadmin.Email+" as "+user.Email {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, cks.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+impersonatedJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "cheesecake", resp)
+
+		req, err = http.NewRequest(http.MethodPost, emails.URL, prepareParams(t, Params{
+			"email": "taken@mail.com",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+impersonatedJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 401, "action is not allowed while impersonating", resp)
+
+		req, err = http.NewRequest(http.MethodGet, audits.URL+"?email="+user.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+
+		lines := strings.Split(string(resp.body), "\n")
+		on := " " + superadmin.Email + " on behalf of " + user.Email + ": "
+		if len(lines) != 3 ||
+			!strings.HasSuffix(lines[0], on+"impersonate -> 200") ||
+			!strings.HasSuffix(lines[1], on+"GET / -> 200") ||
+			!strings.HasSuffix(lines[2], on+"POST / -> 401") {
+			t.Errorf("Unexpected audit %s", resp.body)
+		}
+
+		session, _ := j.ParseJWT(impersonatedJwt)
+		expired, _ := u.sessions.Get(session.UID)
+		u.sessions.Delete(expired.ID)
+		expired.ExpiresAt = time.Now().Add(-time.Second).UnixNano()
+		u.sessions.Add(expired)
+
+		req, err = http.NewRequest(http.MethodGet, cks.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+impersonatedJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 401, "unauthorized", resp)
+	})
+
+	t.Run("only superadmin can impersonate", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.sessions = u.sessions
+
+		imps := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersImpersonate, u.impersonateHandler(j)))))
+		defer func() {
+			imps.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		admin := newAdmin()
+		u.repository.Add(admin.Email, admin)
+
+		superadmin := newSuperadmin()
+		u.repository.Add(superadmin.Email, superadmin)
+
+		otherSuperadmin := newSuperadmin()
+		u.repository.Add(otherSuperadmin.Email, otherSuperadmin)
+
+		for _, tc := range []struct {
+			actor  User
+			target User
+			error  string
+		}{
+			{admin, user, "try to acces superadmin api without superadmin rights"},
+			{superadmin, otherSuperadmin, "not enough rights to performe this action"},
+		} {
+			req, err := http.NewRequest(http.MethodPost, imps.URL, prepareParams(t, Params{
+				"email": tc.target.Email,
+			}))
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+sessionJwt(t, u, j, tc.actor),
+			)
+			resp := doRequest(req, err)
+			assertResponse(t, 401, tc.error, resp)
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const invitePurpose = "invite"
+
+type Invite struct {
+	Email     string
+	Role      Role
+	InvitedBy string
+	Nonce     string
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+type InviteRepository interface {
+	Add(Invite) error
+	Get(email string) (Invite, error)
+	List() []Invite
+	Delete(email string) error
+}
+
+type InMemoryInviteStorage struct {
+	lock    sync.RWMutex
+	invites map[string]Invite
+}
+
+func NewInMemoryInviteStorage() *InMemoryInviteStorage {
+	return &InMemoryInviteStorage{
+		invites: make(map[string]Invite),
+	}
+}
+
+// Add replaces a pending invite of the same email, so only the latest link
+// works.
+func (s *InMemoryInviteStorage) Add(invite Invite) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.invites[invite.Email] = invite
+	return nil
+}
+
+func (s *InMemoryInviteStorage) Get(email string) (Invite, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	invite, ok := s.invites[email]
+	if !ok {
+		return Invite{}, errors.New("invite not found")
+	}
+	return invite, nil
+}
+
+func (s *InMemoryInviteStorage) List() []Invite {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	invites := []Invite{}
+	for _, invite := range s.invites {
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt < invites[j].CreatedAt })
+	return invites
+}
+
+func (s *InMemoryInviteStorage) Delete(email string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.invites[email]; !ok {
+		return errors.New("invite not found")
+	}
+	delete(s.invites, email)
+	return nil
+}
+
+// findInvite resolves an invite link for email. The invite stays pending
+// until the invitee is actually registered.
+func (s *UserService) findInvite(token, email string) (Invite, error) {
+	invalid := errors.New("invalid or expired invite")
+
+	t, err := s.tokens.Verify(invitePurpose, token)
+	if err != nil || t.Subject != email {
+		return Invite{}, invalid
+	}
+
+	invite, err := s.invites.Get(email)
+	if err != nil || invite.Nonce != t.Nonce || time.Now().UnixNano() > invite.ExpiresAt {
+		return Invite{}, invalid
+	}
+	return invite, nil
+}
+
+func (s *UserService) inviteHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &UserRoleParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	params.Email, err = s.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if params.Role == "" {
+		params.Role = adminRole
+	}
+	if !s.policy.HasRole(params.Role) || !s.policy.CanManage(u.Role, params.Role) {
+		writeResponse(w, 401, "not enough rights to performe this action")
+		return
+	}
+
+	if _, err := s.repository.Get(params.Email); err == nil {
+		handleError(errors.New("user "+params.Email+" is already registered"), w)
+		return
+	}
+
+	token, signed, err := s.tokens.Sign(invitePurpose, params.Email, time.Duration(s.emailCfg.InviteTTL))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	invite := Invite{
+		Email:     params.Email,
+		Role:      params.Role,
+		InvitedBy: u.Email,
+		Nonce:     token.Nonce,
+		CreatedAt: time.Now().UnixNano(),
+		ExpiresAt: token.Expires.UnixNano(),
+	}
+	if err := s.invites.Add(invite); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	err = s.sendMail(invite.Email, "You are invited to Cake",
+		u.Email+" invited you to join Cake as "+invite.Role.String()+". To accept, "+
+			"send your email, password and favorite cake in a POST request to "+
+			s.link("/user/register", signed)+" to register. The invite is valid until "+
+			token.Expires.UTC().Format(time.RFC1123)+".")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "invited "+invite.Email+" as "+invite.Role.String())
+	s.notifier <- []byte("invited: " + invite.Email + " as " + invite.Role.String() + " by " + u.Email)
+}
+
+func (s *UserService) listInvitesHandler(w http.ResponseWriter, r *http.Request, u User) {
+	invites := s.invites.List()
+	if len(invites) == 0 {
+		writeResponse(w, http.StatusOK, "there are no pending invites")
+		return
+	}
+
+	now := time.Now()
+	lines := make([]string, len(invites))
+	for i, invite := range invites {
+		status := "expires " + time.Unix(0, invite.ExpiresAt).UTC().Format(time.RFC3339)
+		if now.UnixNano() > invite.ExpiresAt {
+			status = "expired"
+		}
+		lines[i] = invite.Email + " as " + invite.Role.String() + " by " + invite.InvitedBy + " " + status
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+func (s *UserService) revokeInviteHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &UserRoleParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	email, err := s.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	invite, err := s.invites.Get(email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if !s.policy.CanManage(u.Role, invite.Role) {
+		writeResponse(w, 401, "not enough rights to performe this action")
+		return
+	}
+
+	if err := s.invites.Delete(invite.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "invite for "+invite.Email+" revoked")
+	s.notifier <- []byte("invite revoked: " + invite.Email + " by " + u.Email)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdmin_Invites(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("invitee registers with pre-assigned role", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		invites := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInvite, u.inviteHandler))))
+		lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInvite, u.listInvitesHandler))))
+		regs := httptest.NewServer(http.HandlerFunc(u.Register))
+		defer func() {
+			invites.Close()
+			lists.Close()
+			regs.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		admin := newAdmin()
+		adminJwt, _ := j.GenearateJWT(admin)
+		u.repository.Add(admin.Email, admin)
+
+		superadmin := newSuperadmin()
+		superadminJwt, _ := j.GenearateJWT(superadmin)
+		u.repository.Add(superadmin.Email, superadmin)
+
+		invite := func(jwt string, params Params) parsedResponse {
+			req, err := http.NewRequest(http.MethodPost, invites.URL, prepareParams(t, params))
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+jwt,
+			)
+			return doRequest(req, err)
+		}
+
+		resp := invite(adminJwt, Params{"email": "invitee@mail.com"})
+		assertResponse(t, 401, "try to acces superadmin api without superadmin rights", resp)
+
+		resp = invite(superadminJwt, Params{"email": "invitee@mail.com", "role": "superadmin"})
+		assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+		resp = invite(superadminJwt, Params{"email": user.Email})
+		assertResponse(t, 422, "user "+user.Email+" is already registered", resp)
+
+		resp = invite(superadminJwt, Params{"email": "invitee@mail.com"})
+		assertResponse(t, http.StatusOK, "invited invitee@mail.com as admin", resp)
+
+		if msg := string(<-u.notifier); msg != "invited: invitee@mail.com as admin by "+superadmin.Email {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, lists.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+		if !strings.HasPrefix(string(resp.body), "invitee@mail.com as admin by "+superadmin.Email+" expires ") {
+			t.Errorf("Unexpected invites %s", resp.body)
+		}
+
+		token := mailedToken(t, u, "invitee@mail.com")
+
+		register := func(email string) parsedResponse {
+			return doRequest(http.NewRequest(http.MethodPost, regs.URL+"?token="+url.QueryEscape(token), prepareParams(t, Params{
+				"email":         email,
+				"password":      "brandnewpass",
+				"favorite_cake": "cheesecake",
+			})))
+		}
+
+		resp = register("other@mail.com")
+		assertResponse(t, 422, "invalid or expired invite", resp)
+
+		resp = register("invitee@mail.com")
+		assertResponse(t, http.StatusCreated, "registered", resp)
+
+		invitee, err := u.repository.Get("invitee@mail.com")
+		if err != nil || invitee.Role != adminRole || invitee.PendingVerification {
+			t.Fatalf("Unexpected invitee %v", invitee)
+		}
+
+		<-u.notifier
+		if msg := string(<-u.notifier); msg != "accepted invite: invitee@mail.com as admin" {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		if _, err := u.invites.Get("invitee@mail.com"); err == nil {
+			t.Errorf("Invite must be consumed on registration")
+		}
+	})
+
+	t.Run("revoked invite", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		invites := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInvite, u.inviteHandler))))
+		revokes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInvite, u.revokeInviteHandler))))
+		regs := httptest.NewServer(http.HandlerFunc(u.Register))
+		defer func() {
+			invites.Close()
+			revokes.Close()
+			regs.Close()
+		}()
+
+		superadmin := newSuperadmin()
+		superadminJwt, _ := j.GenearateJWT(superadmin)
+		u.repository.Add(superadmin.Email, superadmin)
+
+		req, err := http.NewRequest(http.MethodPost, invites.URL, prepareParams(t, Params{
+			"email": "invitee@mail.com",
+			"role":  "user",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+		resp := doRequest(req, err)
+		assertResponse(t, http.StatusOK, "invited invitee@mail.com as user", resp)
+
+		token := mailedToken(t, u, "invitee@mail.com")
+
+		req, err = http.NewRequest(http.MethodPost, revokes.URL, prepareParams(t, Params{
+			"email": "invitee@mail.com",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+superadminJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "invite for invitee@mail.com revoked", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+			"email":         "invitee@mail.com",
+			"password":      "brandnewpass",
+			"favorite_cake": "cheesecake",
+			"invite":        token,
+		})))
+		assertResponse(t, 422, "invalid or expired invite", resp)
+	})
+}
@@ -6,12 +6,19 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/openware/rango/pkg/auth"
 )
 
+// jwtLifetime is how long tokens forged by rango stay valid.
+const jwtLifetime = time.Hour
+
 type JWTService struct {
-	keys *auth.KeyStore
+	keys     *auth.KeyStore
+	apiKeys  APIKeyRepository
+	sessions SessionRepository
+	audit    AuditRepository
 }
 
 func NewJWTService(privKeyPath, pubKeyPath string) (*JWTService, error) {
@@ -28,6 +35,13 @@ func (j *JWTService) GenearateJWT(u User) (string, error) {
 		PrivateKey, nil)
 }
 
+// GenerateSessionJWT binds the token to a session through its uid claim, so
+// deleting the session revokes the token.
+func (j *JWTService) GenerateSessionJWT(u User, session Session) (string, error) {
+	return auth.ForgeToken(session.ID, u.Email, "empty", 0, j.keys.
+		PrivateKey, nil)
+}
+
 func (j *JWTService) ParseJWT(jwt string) (auth.Auth, error) {
 	return auth.ParseAndValidate(jwt, j.keys.PublicKey)
 }
@@ -49,30 +63,149 @@ func (u *UserService) JWT(
 		return
 	}
 
+	email, err := u.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
 	passwordDigest := md5.New().Sum([]byte(params.Password))
-	user, err := u.repository.Get(params.Email)
+	user, err := u.repository.Get(email)
 	if err != nil {
+		u.recordUnknownLogin(r, email)
 		handleError(err, w)
 		return
 	}
 
 	if UserHasBan(user) {
+		u.recordLogin(r, user.Email, loginBanned)
 		writeResponse(w, 401, "user "+user.Email+" has ban due to '"+(*user.BanHistory)[len(*user.BanHistory)-1].WhyBanned+"'")
 		return
 	}
 
+	now := time.Now()
+	if isLockedOut(w, user, now) {
+		u.recordLogin(r, user.Email, loginLockedOut)
+		return
+	}
+
 	if string(passwordDigest) != user.PasswordDigest {
+		u.recordLogin(r, user.Email, loginBadPassword)
+		u.recordFailedLogin(user, now)
 		handleError(errors.New("invalid login params"), w)
 		return
 	}
 
-	token, err := jwtService.GenearateJWT(user)
+	if user.PendingVerification {
+		u.recordLogin(r, user.Email, loginUnverified)
+		writeResponse(w, 401, "email "+user.Email+" is not verified")
+		return
+	}
+
+	if user.TOTPEnabled {
+		challenge, err := u.startTwoFactorChallenge(user)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+
+		writeResponse(w, http.StatusAccepted, challenge)
+		return
+	}
+
+	u.issueJWT(w, r, user, jwtService)
+}
+
+func (u *UserService) recordFailedLogin(user User, now time.Time) {
+	user.FailedLogins++
+	if lockout := u.lockout.lockoutFor(user.FailedLogins); lockout > 0 {
+		user.LockedUntil = now.Add(lockout).UnixNano()
+	}
+	u.repository.Update(user.Email, user)
+}
+
+func (u *UserService) issueJWT(w http.ResponseWriter, r *http.Request, user User, jwtService *JWTService) {
+	if user.FailedLogins != 0 || user.LockedUntil != 0 {
+		user.FailedLogins = 0
+		user.LockedUntil = 0
+		u.repository.Update(user.Email, user)
+	}
+
+	session, err := u.startSession(r, user.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	token, err := jwtService.GenerateSessionJWT(user, session)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
 
 	writeResponse(w, http.StatusOK, token)
+	u.recordLogin(r, user.Email, loginSuccess)
+}
+
+func isLockedOut(w http.ResponseWriter, user User, now time.Time) bool {
+	if user.LockedUntil <= now.UnixNano() {
+		return false
+	}
+
+	throttledLogins.WithLabelValues("lockout").Inc()
+	writeTooManyRequests(w, time.Duration(user.LockedUntil-now.UnixNano()),
+		"account is temporarily locked due to failed login attempts")
+	return true
+}
+
+// authenticate accepts either a JWT or an api key. Requests made with an api
+// key carry it in their context, so Policy.Require can check its scopes;
+// requests made with a JWT carry their session once sessions are tracked.
+func (j *JWTService) authenticate(users UserRepository, token string, r *http.Request) (User, *http.Request, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := lookupAPIKey(j.apiKeys, token, time.Now())
+		if err != nil {
+			return User{}, r, err
+		}
+
+		user, err := users.Get(key.Owner)
+		if err != nil {
+			return User{}, r, err
+		}
+
+		return user, r.WithContext(withAPIKey(r.Context(), key)), nil
+	}
+
+	auth, err := j.ParseJWT(token)
+	if err != nil {
+		return User{}, r, err
+	}
+
+	user, err := users.Get(auth.Email)
+	if err != nil {
+		return User{}, r, err
+	}
+	if j.sessions == nil {
+		return user, r, nil
+	}
+
+	now := time.Now()
+	session, err := j.sessions.Get(auth.UID)
+	if err != nil || session.Email != user.Email || session.Expired(now) {
+		return User{}, r, errors.New("session was deleted")
+	}
+
+	if session.ImpersonatedBy != "" {
+		actor, err := users.Get(session.ImpersonatedBy)
+		if err != nil || UserHasBan(actor) {
+			return User{}, r, errors.New("impersonating user lost access")
+		}
+	}
+
+	session.LastSeenAt = now.UnixNano()
+	j.sessions.Touch(session.ID, session.LastSeenAt)
+
+	return user, r.WithContext(withSession(r.Context(), session)), nil
 }
 
 type ProtectedHandler func(rw http.ResponseWriter, r *http.Request, u User)
@@ -80,27 +213,45 @@ type ProtectedHandler func(rw http.ResponseWriter, r *http.Request, u User)
 func (j *JWTService) JWTAuth(
 	users UserRepository,
 	h ProtectedHandler,
+) http.HandlerFunc {
+	return j.jwtAuth(users, h, false)
+}
+
+func (j *JWTService) JWTAuthForPasswordChange(
+	users UserRepository,
+	h ProtectedHandler,
+) http.HandlerFunc {
+	return j.jwtAuth(users, h, true)
+}
+
+func (j *JWTService) jwtAuth(
+	users UserRepository,
+	h ProtectedHandler,
+	allowPendingPasswordChange bool,
 ) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		token := strings.TrimPrefix(authHeader, "Bearer ")
 
-		auth, err := j.ParseJWT(token)
+		user, r, err := j.authenticate(users, token, r)
 		if err != nil {
 			rw.WriteHeader(401)
 			rw.Write([]byte("unauthorized"))
 			return
 		}
 
-		user, err := users.Get(auth.Email)
-		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
+		if UserHasBan(user) {
+			writeResponse(rw, 401, "user "+user.Email+" has ban due to '"+(*user.BanHistory)[len(*user.BanHistory)-1].WhyBanned+"'")
 			return
 		}
 
-		if UserHasBan(user) {
-			writeResponse(rw, 401, "user "+user.Email+" has ban due to '"+(*user.BanHistory)[len(*user.BanHistory)-1].WhyBanned+"'")
+		if user.MustChangePassword && !allowPendingPasswordChange {
+			writeResponse(rw, 401, "password change required")
+			return
+		}
+
+		if actor, ok := impersonatorFromContext(r.Context()); ok {
+			j.audited(actor, h)(rw, r, user)
 			return
 		}
 
@@ -26,7 +26,19 @@ func (w *logWriter) Write(p []byte) (int, error) {
 	return w.ResponseWriter.Write(p)
 }
 
+const redacted = "[redacted]"
+
 func logRequest(h http.HandlerFunc) http.HandlerFunc {
+	return logRequestWith(h, false)
+}
+
+// logSensitiveRequest is logRequest for routes whose params or responses
+// carry credentials: passwords, tokens, api keys and 2fa secrets.
+func logSensitiveRequest(h http.HandlerFunc) http.HandlerFunc {
+	return logRequestWith(h, true)
+}
+
+func logRequestWith(h http.HandlerFunc, redact bool) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		writer := &logWriter{
 			ResponseWriter: rw,
@@ -45,13 +57,17 @@ func logRequest(h http.HandlerFunc) http.HandlerFunc {
 		done := time.Since(started)
 		requestRecords.WithLabelValues(r.URL.Path).Observe(done.Seconds())
 
+		params, response := string(body), writer.response.String()
+		if redact {
+			params, response = redacted, redacted
+		}
 		log.Printf(
 			"PATH: %s -> %d. Finished in %v.\n\tParams: %s\n\tResponse: %s",
 			r.URL.Path,
 			writer.statusCode,
 			done,
-			string(body),
-			writer.response.String(),
+			params,
+			response,
 		)
 	}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogRequest(t *testing.T) {
+	doRequest := createRequester(t)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	u := newTestUserService()
+	j := newTestJwtService(t)
+	j.apiKeys = u.apiKeys
+
+	keys := httptest.NewServer(logSensitiveRequest(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.CreateAPIKeyHandler))))
+	cakes := httptest.NewServer(logRequest(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.UpdateFavoriteCakeHandler))))
+	defer func() {
+		keys.Close()
+		cakes.Close()
+	}()
+
+	admin := newAdmin()
+	u.repository.Add(admin.Email, admin)
+	jwt, _ := j.GenearateJWT(admin)
+
+	send := func(url string, params Params) parsedResponse {
+		req, err := http.NewRequest(http.MethodPost, url, prepareParams(t, params))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+jwt,
+		)
+		return doRequest(req, err)
+	}
+
+	resp := send(keys.URL, Params{"name": "ci", "scopes": []string{"users.inspect"}})
+	assertStatus(t, http.StatusCreated, resp)
+	if len(resp.body) == 0 || strings.Contains(logs.String(), string(resp.body)) {
+		t.Errorf("Expected api key not to be logged but got %s", logs.String())
+	}
+	if strings.Contains(logs.String(), `"scopes"`) {
+		t.Errorf("Expected params not to be logged but got %s", logs.String())
+	}
+
+	logs.Reset()
+	resp = send(cakes.URL, Params{"favorite_cake": "napoleon"})
+	assertStatus(t, http.StatusOK, resp)
+	<-u.notifier
+	if !strings.Contains(logs.String(), "napoleon") || !strings.Contains(logs.String(), "favorite cake changed") {
+		t.Errorf("Expected params and response to be logged but got %s", logs.String())
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LoginResult string
+
+const (
+	loginSuccess         LoginResult = "success"
+	loginBadPassword     LoginResult = "bad password"
+	loginBanned          LoginResult = "banned"
+	loginUnknownUser     LoginResult = "unknown user"
+	loginLockedOut       LoginResult = "locked out"
+	loginUnverified      LoginResult = "unverified"
+	loginBadSecondFactor LoginResult = "bad second factor"
+)
+
+type LoginAttempt struct {
+	Email     string
+	At        int64
+	IP        string
+	UserAgent string
+	Result    LoginResult
+}
+
+func (a LoginAttempt) device() string {
+	return a.IP + " '" + a.UserAgent + "'"
+}
+
+type LoginHistoryRepository interface {
+	Add(LoginAttempt) error
+	List(email string) []LoginAttempt
+	Devices(email string) []string
+	Move(from, to string) error
+	AddUnknown(LoginAttempt) error
+	ListUnknown() []LoginAttempt
+}
+
+// unknownLoginsSize is how many attempts on emails without an account are
+// kept, across all such emails.
+const unknownLoginsSize = 1000
+
+// InMemoryLoginHistory keeps the last size attempts per email, newest
+// first, and every device an email has ever logged in from successfully.
+// Attempts on emails without an account are kept apart, so an account
+// registered later does not inherit them.
+type InMemoryLoginHistory struct {
+	lock     sync.RWMutex
+	size     int
+	attempts map[string][]LoginAttempt
+	devices  map[string]map[string]bool
+	unknown  []LoginAttempt
+}
+
+func NewInMemoryLoginHistory(size int) *InMemoryLoginHistory {
+	return &InMemoryLoginHistory{
+		size:     size,
+		attempts: make(map[string][]LoginAttempt),
+		devices:  make(map[string]map[string]bool),
+	}
+}
+
+func (h *InMemoryLoginHistory) Add(attempt LoginAttempt) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	attempts := append([]LoginAttempt{attempt}, h.attempts[attempt.Email]...)
+	if len(attempts) > h.size {
+		attempts = attempts[:h.size]
+	}
+	h.attempts[attempt.Email] = attempts
+
+	if attempt.Result == loginSuccess {
+		if h.devices[attempt.Email] == nil {
+			h.devices[attempt.Email] = make(map[string]bool)
+		}
+		h.devices[attempt.Email][attempt.device()] = true
+	}
+	return nil
+}
+
+func (h *InMemoryLoginHistory) List(email string) []LoginAttempt {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return append([]LoginAttempt{}, h.attempts[email]...)
+}
+
+func (h *InMemoryLoginHistory) Devices(email string) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	devices := []string{}
+	for device := range h.devices[email] {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+func (h *InMemoryLoginHistory) AddUnknown(attempt LoginAttempt) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.unknown = append([]LoginAttempt{attempt}, h.unknown...)
+	if len(h.unknown) > unknownLoginsSize {
+		h.unknown = h.unknown[:unknownLoginsSize]
+	}
+	return nil
+}
+
+// ListUnknown returns the attempts on emails without an account, newest
+// first.
+func (h *InMemoryLoginHistory) ListUnknown() []LoginAttempt {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return append([]LoginAttempt{}, h.unknown...)
+}
+
+// Move hands the attempts and devices of from over to to.
+func (h *InMemoryLoginHistory) Move(from, to string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	attempts := append(h.attempts[from], h.attempts[to]...)
+	for i := range attempts {
+		attempts[i].Email = to
+	}
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].At > attempts[j].At })
+	if len(attempts) > h.size {
+		attempts = attempts[:h.size]
+	}
+	delete(h.attempts, from)
+	if len(attempts) > 0 {
+		h.attempts[to] = attempts
+	}
+
+	for device := range h.devices[from] {
+		if h.devices[to] == nil {
+			h.devices[to] = make(map[string]bool)
+		}
+		h.devices[to][device] = true
+	}
+	delete(h.devices, from)
+	return nil
+}
+
+// recordLogin stores a /user/jwt attempt on an existing account. A
+// successful login from a device the account never used before is announced
+// to that account, unless it is its very first login.
+func (s *UserService) recordLogin(r *http.Request, email string, result LoginResult) {
+	attempt := LoginAttempt{
+		Email:     email,
+		At:        time.Now().UnixNano(),
+		IP:        clientIP(r),
+		UserAgent: userAgent(r),
+		Result:    result,
+	}
+
+	newDevice := false
+	if result == loginSuccess {
+		devices := s.logins.Devices(email)
+		i := sort.SearchStrings(devices, attempt.device())
+		newDevice = len(devices) > 0 && (i == len(devices) || devices[i] != attempt.device())
+	}
+
+	s.logins.Add(attempt)
+
+	if newDevice {
+		s.notifier <- userEvent(email, "new device: "+attempt.device())
+	}
+}
+
+// recordUnknownLogin stores a /user/jwt attempt on an email that has no
+// account.
+func (s *UserService) recordUnknownLogin(r *http.Request, email string) {
+	s.logins.AddUnknown(LoginAttempt{
+		Email:     email,
+		At:        time.Now().UnixNano(),
+		IP:        clientIP(r),
+		UserAgent: userAgent(r),
+		Result:    loginUnknownUser,
+	})
+}
+
+func formatLogins(attempts []LoginAttempt) string {
+	lines := make([]string, len(attempts))
+	for i, attempt := range attempts {
+		lines[i] = time.Unix(0, attempt.At).UTC().Format(time.RFC3339) + " " +
+			string(attempt.Result) + " from " + attempt.device()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *UserService) LoginHistoryHandler(w http.ResponseWriter, r *http.Request, u User) {
+	attempts := s.logins.List(u.Email)
+	if len(attempts) == 0 {
+		writeResponse(w, http.StatusOK, "user "+u.Email+" does not have any logins")
+		return
+	}
+
+	writeResponse(w, http.StatusOK, formatLogins(attempts))
+}
+
+// unknownLoginsHandler shows admins the login attempts on emails that have
+// no account, optionally only those on one email.
+func (s *UserService) unknownLoginsHandler(w http.ResponseWriter, r *http.Request, u User) {
+	email := ""
+	if value := r.URL.Query().Get("email"); value != "" {
+		var err error
+		if email, err = s.normalizeEmail(value); err != nil {
+			handleError(err, w)
+			return
+		}
+	}
+
+	lines := []string{}
+	for _, attempt := range s.logins.ListUnknown() {
+		if email == "" || attempt.Email == email {
+			lines = append(lines, attempt.Email+" "+formatLogins([]LoginAttempt{attempt}))
+		}
+	}
+	if len(lines) == 0 {
+		writeResponse(w, http.StatusOK, "there are no logins of unknown users")
+		return
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
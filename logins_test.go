@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUsers_LoginHistory(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("login attempts are recorded", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		logins := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.LoginHistoryHandler))))
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
+		unknowns := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.unknownLoginsHandler))))
+		defer func() {
+			jwts.Close()
+			logins.Close()
+			inspects.Close()
+			unknowns.Close()
+		}()
+
+		user := newUser()
+		userJwt, _ := j.GenearateJWT(user)
+		u.repository.Add(user.Email, user)
+
+		admin := newAdmin()
+		adminJwt, _ := j.GenearateJWT(admin)
+		u.repository.Add(admin.Email, admin)
+
+		login := func(email, password string) {
+			req, err := http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+				"email":    email,
+				"password": password,
+			}))
+			req.Header.Set("User-Agent", "laptop")
+			doRequest(req, err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, logins.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp := doRequest(req, err)
+		assertResponse(t, http.StatusOK, "user "+user.Email+" does not have any logins", resp)
+
+		login("nobody@mail.com", DefaultPassword)
+		login(user.Email, "wrong password")
+		login(user.Email, DefaultPassword)
+
+		if attempts := u.logins.List("nobody@mail.com"); len(attempts) != 0 {
+			t.Errorf("Attempts on unknown emails must not be kept for an account but got %v", attempts)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, unknowns.URL+"?email=Nobody@mail.com", nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+		if !strings.HasPrefix(string(resp.body), "nobody@mail.com ") ||
+			!strings.HasSuffix(string(resp.body), " unknown user from 127.0.0.1 'laptop'") {
+			t.Errorf("Unexpected unknown logins %s", resp.body)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, unknowns.URL+"?email="+user.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "there are no logins of unknown users", resp)
+
+		req, err = http.NewRequest(http.MethodGet, logins.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+
+		lines := strings.Split(string(resp.body), "\n")
+		if len(lines) != 2 ||
+			!strings.HasSuffix(lines[0], " success from 127.0.0.1 'laptop'") ||
+			!strings.HasSuffix(lines[1], " bad password from 127.0.0.1 'laptop'") {
+			t.Errorf("Unexpected login history %s", resp.body)
+		}
+
+		u.BanUser(user.Email, admin.Email, "spam")
+		login(user.Email, DefaultPassword)
+
+		req, err = http.NewRequest(http.MethodGet, inspects.URL+"?email="+user.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+
+		if !strings.Contains(string(resp.body), "\nlast logins:\n") ||
+			!strings.Contains(string(resp.body), " banned from 127.0.0.1 'laptop'") {
+			t.Errorf("Unexpected inspect response %s", resp.body)
+		}
+	})
+
+	t.Run("login from new device", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer func() {
+			jwts.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		login := func(agent string) {
+			req, err := http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+				"email":    user.Email,
+				"password": DefaultPassword,
+			}))
+			req.Header.Set("User-Agent", agent)
+			assertStatus(t, http.StatusOK, doRequest(req, err))
+		}
+
+		login("laptop") // the first device is not news
+		login("laptop")
+		login("phone")
+		login("phone")
+
+		if msg := string(<-u.notifier); msg != "@"+user.Email+" new device: 127.0.0.1 'phone'" {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		select {
+		case msg := <-u.notifier:
+			t.Errorf("Unexpected notification %s", msg)
+		default:
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+)
+
+type Mail struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	SentAt  time.Time
+}
+
+type Mailer interface {
+	Send(Mail) error
+}
+
+func NewMailer(cfg config.EmailConfig) (Mailer, error) {
+	switch cfg.Mailer {
+	case "memory":
+		return NewInMemoryMailer(), nil
+	case "file":
+		return NewFileMailer(cfg.OutboxPath), nil
+	}
+	return nil, errors.New("unknown mailer '" + cfg.Mailer + "'")
+}
+
+type InMemoryMailer struct {
+	lock sync.RWMutex
+	sent []Mail
+}
+
+func NewInMemoryMailer() *InMemoryMailer {
+	return &InMemoryMailer{}
+}
+
+func (m *InMemoryMailer) Send(mail Mail) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+func (m *InMemoryMailer) Last(to string) (Mail, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+type FileMailer struct {
+	lock sync.Mutex
+	path string
+}
+
+func NewFileMailer(path string) *FileMailer {
+	return &FileMailer{path: path}
+}
+
+func (m *FileMailer) Send(mail Mail) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nFrom: %s\nTo: %s\nSubject: %s\n\n%s\n---\n",
+		mail.SentAt.Format(time.RFC1123Z), mail.From, mail.To, mail.Subject, mail.Body)
+	return err
+}
@@ -2,20 +2,23 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"errors"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/Hudanov/Cake-REST-API/config"
 	"github.com/gorilla/mux"
 )
 
 func (us *UserService) getCakeHandler(w http.ResponseWriter, r *http.Request, u User) {
-	w.Write([]byte(u.FavoriteCake))
-	cakesGiven.Inc()
+	if r.URL.Query().Get("all") == "true" {
+		w.Write([]byte(us.formatFavoriteCakes(u)))
+	} else {
+		w.Write([]byte(us.cakeName(u.FavoriteCakeID)))
+	}
 }
 
 func wrapJwt(
@@ -27,72 +30,259 @@ func wrapJwt(
 	}
 }
 
-func (s *UserService) addSuperadmin() error {
-	superadminEmail, err := os.LookupEnv("CAKE_ADMIN_EMAIL")
-	if !err {
-		return errors.New("undefined superadmin email")
+func main() {
+	cfg, args, err := config.Load("cake", os.Args[1:], config.Default())
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", err)
 	}
-	superadminPassword, err := os.LookupEnv("CAKE_ADMIN_PASSWORD")
-	if !err {
-		return errors.New("undefined superadmin password")
+
+	if len(args) > 0 {
+		if err := cfg.Run(args, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	superadmin := User{
-		Email:          superadminEmail,
-		PasswordDigest: string(md5.New().Sum([]byte(superadminPassword))),
-		FavoriteCake:   "napoleon",
-		Role:           superadminRole,
+	r := mux.NewRouter()
+
+	policy := DefaultPolicy()
+	if cfg.API.PolicyPath != "" {
+		policy, err = LoadPolicy(cfg.API.PolicyPath)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	addErr := s.repository.Add(superadmin.Email, superadmin)
-	if addErr != nil {
-		return addErr
+	mailer, err := NewMailer(cfg.Email)
+	if err != nil {
+		log.Fatalf("Failed to create mailer: %s", err)
 	}
 
-	return nil
-}
+	tokens, err := NewTokenSigner(cfg.Tokens.Secret.Value())
+	if err != nil {
+		panic(err)
+	}
 
-func main() {
-	os.Setenv("CAKE_ADMIN_EMAIL", "superadmin@openware.com")
-	os.Setenv("CAKE_ADMIN_PASSWORD", "12345678")
+	domains, err := NewDomainPolicy(cfg.Domains)
+	if err != nil {
+		log.Fatalf("Failed to load domain policy: %s", err)
+	}
 
-	r := mux.NewRouter()
+	catalog := DefaultCakes()
+	if cfg.API.CatalogPath != "" {
+		catalog, err = LoadCakes(cfg.API.CatalogPath)
+		if err != nil {
+			log.Fatalf("Failed to load cake catalog: %s", err)
+		}
+	}
+	birthdays, err := NewFileBirthdayLog(cfg.API.BirthdaysLogPath)
+	if err != nil {
+		log.Fatalf("Failed to load birthdays log: %s", err)
+	}
+
+	cakes := NewInMemoryCakeStorage()
+	for _, cake := range catalog {
+		if err := cakes.Add(cake); err != nil {
+			log.Fatalf("Failed to load cake catalog: %s", err)
+		}
+	}
 
 	users := NewInMemoryUserStorage()
+	apiKeys := NewInMemoryAPIKeyStorage()
+	sessions := NewInMemorySessionStorage()
+	audit := NewInMemoryAuditLog()
 	userService := UserService{
-		notifier:   make(chan []byte, 10),
+		notifier:   make(chan []byte, cfg.API.NotifierBuffer),
 		repository: users,
+		policy:     policy,
+		lockout:    NewLockoutPolicy(cfg.Login),
+		passwords:  NewPasswordPolicy(cfg.Password),
+		mailer:     mailer,
+		tokens:     tokens,
+		resets:     NewInMemoryPasswordResetStorage(),
+		emailCfg:   cfg.Email,
+		twoFactor:  cfg.TwoFactor,
+		apiKeys:    apiKeys,
+		apiKeysCfg: cfg.APIKeys,
+		sessions:   sessions,
+		logins:     NewInMemoryLoginHistory(cfg.Login.HistorySize),
+		audit:      audit,
+		invites:    NewInMemoryInviteStorage(),
+		domains:    domains,
+		cakes:      cakes,
+		stats:      NewCakeStats(users.List()),
+		reviews:    NewInMemoryReviewStorage(),
+		orders:     NewInMemoryOrderStorage(),
+		gifts:      NewInMemoryGiftStorage(),
+		giftsCfg:   cfg.Gifts,
+		recipes:    NewInMemoryRecipeStorage(),
+		birthdays:  birthdays,
+
+		recommender: NewRecommender(),
+		clock:       time.Now,
+
+		impersonationTTL: cfg.API.ImpersonationTTL,
 	}
 
-	userService.addSuperadmin()
+	collisions, err := userService.migrateEmails()
+	if err != nil {
+		log.Fatalf("Failed to migrate emails: %s", err)
+	}
+	for _, collision := range collisions {
+		log.Printf("Email collision: accounts %s all normalize to %s", strings.Join(collision.Accounts, ", "), collision.Email)
+	}
 
-	jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+	if err := userService.addSuperadmin(cfg.Superadmin); err != nil {
+		log.Fatalf("Failed to bootstrap superadmin: %s", err)
+	}
+
+	jwtService, err := NewJWTService(cfg.Keys.PrivateKeyPath, cfg.Keys.PublicKeyPath)
 	if err != nil {
 		panic(err)
 	}
+	jwtService.apiKeys = apiKeys
+	jwtService.sessions = sessions
+	jwtService.audit = audit
+
+	userService.rebuildRecommendations()
+	go userService.runRecommendations(time.Duration(cfg.API.RecommendationsInterval))
+	go userService.runBirthdays(time.Duration(cfg.API.BirthdaysInterval))
+	go userService.runSessionsSweep(time.Duration(cfg.API.SessionsSweepInterval))
 
-	go runPublisher(userService.notifier)
-	go startProm()
+	go runPublisher(userService.notifier, cfg.AMQP)
+	go startProm(cfg.Metrics.Addr)
 
-	r.HandleFunc("/cake", logRequest(jwtService.JWTAuth(users, userService.getCakeHandler))).Methods(http.MethodGet)
-	r.HandleFunc("/user/me", logRequest(jwtService.JWTAuth(users, userService.getCakeHandler))).Methods(http.MethodGet)
-	r.HandleFunc("/user/register", logRequest(userService.Register)).Methods(http.MethodPost)
-	r.HandleFunc("/user/favorite_cake", logRequest(jwtService.
-		JWTAuth(users, userService.UpdateFavoriteCakeHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/user/email", logRequest(jwtService.
-		JWTAuth(users, userService.UpdateEmailHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/user/password", logRequest(jwtService.
-		JWTAuth(users, userService.UpdatePasswordHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/user/jwt", logRequest(wrapJwt(jwtService, userService.JWT))).Methods(http.MethodPost)
+	r.HandleFunc("/cake", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.getCakeHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/me", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.getCakeHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/me/logins", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.LoginHistoryHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.listCakesHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes/stats", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.cakeStatsHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes/recommended", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.recommendationsHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes/reviews", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.listReviewsHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes/reviews", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.reviewCakeHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/cakes/reviews/history", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.reviewHistoryHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes/recipe", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.recipeHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes/recipe/history", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.recipeHistoryHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/cakes/recipe/diff", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.recipeDiffHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/orders", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.listOrdersHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/orders", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.placeOrderHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/orders/{id}/cancel", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.cancelOrderHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/gifts", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.sendGiftHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/gifts/inbox", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.giftInboxHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/gifts/outbox", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileRead, userService.giftOutboxHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/gifts/{id}/accept", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.answerGift(giftAccepted))))).Methods(http.MethodPost)
+	r.HandleFunc("/gifts/{id}/decline", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.answerGift(giftDeclined))))).Methods(http.MethodPost)
+	r.HandleFunc("/user/register", logSensitiveRequest(userService.Register)).Methods(http.MethodPost)
+	r.HandleFunc("/user/verify", logSensitiveRequest(userService.VerifyEmailHandler)).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/user/verify/resend", logRequest(userService.ResendVerificationHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/user/favorite_cake", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.UpdateFavoriteCakeHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/favorite_cakes", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.UpdateFavoriteCakesHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/birthday", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permProfileWrite, userService.UpdateBirthdayHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/email", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.UpdateEmailHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/password", logSensitiveRequest(jwtService.JWTAuthForPasswordChange(users,
+		policy.Require(permAccount, userService.UpdatePasswordHandler)))).Methods(http.MethodPost)
+	loginLimiter := NewLoginLimiter(cfg.Login)
+	loginLimiter.normalize = userService.normalizeEmail
+	r.HandleFunc("/user/password/forgot", logRequest(userService.ForgotPasswordHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/user/password/reset", logSensitiveRequest(userService.ResetPasswordHandler)).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/user/jwt", logSensitiveRequest(loginLimiter.
+		Limit(wrapJwt(jwtService, userService.JWT)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/jwt/2fa", logSensitiveRequest(loginLimiter.
+		Limit(wrapJwt(jwtService, userService.TwoFactorLogin)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/2fa/enroll", logSensitiveRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.EnrollTwoFactorHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/2fa/confirm", logSensitiveRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.ConfirmTwoFactorHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/2fa/disable", logSensitiveRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.DisableTwoFactorHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/keys", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.ListAPIKeysHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/keys", logSensitiveRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.CreateAPIKeyHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/sessions", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.ListSessionsHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/sessions/{id}", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.DeleteSessionHandler)))).Methods(http.MethodDelete)
+	r.HandleFunc("/user/keys/revoke", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permAccount, userService.RevokeAPIKeyHandler)))).Methods(http.MethodPost)
 
-	r.HandleFunc("/admin/promote", logRequest(jwtService.JWTAuth(users, userService.promoteUser))).Methods(http.MethodPost)
-	r.HandleFunc("/admin/fire", logRequest(jwtService.JWTAuth(users, userService.fireUser))).Methods(http.MethodPost)
-	r.HandleFunc("/admin/ban", logRequest(jwtService.JWTAuth(users, userService.banUserHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/admin/unban", logRequest(jwtService.JWTAuth(users, userService.unbanUserHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/admin/inspect", logRequest(jwtService.JWTAuth(users, userService.inspectUserHandler))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/promote", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersPromote, userService.promoteUser)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/fire", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersPromote, userService.fireUser)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/ban", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersBan, userService.banUserHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/unban", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersBan, userService.unbanUserHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/reviews/hide", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersBan, userService.hideReviewHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/reviews/remove", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersBan, userService.removeReviewHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/birthdays", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersInspect, userService.upcomingBirthdaysHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/sessions", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersSessions, userService.adminListSessionsHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/sessions/{id}", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersSessions, userService.adminDeleteSessionHandler)))).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/impersonate", logSensitiveRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersImpersonate, userService.impersonateHandler(jwtService))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/audit", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersImpersonate, userService.auditHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/invite", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersInvite, userService.inviteHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/invites", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersInvite, userService.listInvitesHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/invite/revoke", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersInvite, userService.revokeInviteHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/domains", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permDomainsManage, userService.listDomainsHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/domains", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permDomainsManage, userService.addDomainHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/domains/remove", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permDomainsManage, userService.removeDomainHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/orders", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permOrdersManage, userService.adminListOrdersHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/orders/{id}", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permOrdersManage, userService.moveOrderHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/cakes", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permCakesManage, userService.createCakeHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/cakes/{id}", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permCakesManage, userService.updateCakeHandler)))).Methods(http.MethodPut)
+	r.HandleFunc("/admin/cakes/{id}", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permCakesManage, userService.deleteCakeHandler)))).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/cakes/{id}/recipe", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permCakesManage, userService.saveRecipeHandler)))).Methods(http.MethodPut)
+	r.HandleFunc("/admin/inspect", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersInspect, userService.inspectUserHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/logins/unknown", logRequest(jwtService.JWTAuth(users,
+		policy.Require(permUsersInspect, userService.unknownLoginsHandler)))).Methods(http.MethodGet)
 
 	srv := http.Server{
-		Addr:    ":8080",
+		Addr:    cfg.API.Addr,
 		Handler: r,
 	}
 
@@ -100,7 +290,7 @@ func main() {
 	signal.Notify(interrupt, os.Interrupt)
 	go func() {
 		<-interrupt
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.API.ShutdownTimeout))
 		defer cancel()
 		srv.Shutdown(ctx)
 	}()
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	orderMaxQuantity   = 20
+	orderNoteMaxLength = 500
+)
+
+type OrderState string
+
+const (
+	orderPlaced    OrderState = "placed"
+	orderBaking    OrderState = "baking"
+	orderReady     OrderState = "ready"
+	orderDelivered OrderState = "delivered"
+	orderCancelled OrderState = "cancelled"
+)
+
+// orderTransitions lists the states an order can move to from each state.
+// Delivered and cancelled orders are final.
+var orderTransitions = map[OrderState][]OrderState{
+	orderPlaced: {orderBaking, orderCancelled},
+	orderBaking: {orderReady, orderCancelled},
+	orderReady:  {orderDelivered, orderCancelled},
+}
+
+func parseOrderState(state string) (OrderState, error) {
+	switch s := OrderState(state); s {
+	case orderPlaced, orderBaking, orderReady, orderDelivered, orderCancelled:
+		return s, nil
+	}
+	return "", errors.New("unknown order state " + state)
+}
+
+type OrderTransition struct {
+	State OrderState
+	By    string
+	At    int64
+}
+
+type Order struct {
+	ID       int
+	Email    string
+	CakeID   string
+	Quantity int
+	Note     string
+	State    OrderState
+	PlacedAt int64
+	History  []OrderTransition
+}
+
+func (o Order) CanMove(to OrderState) bool {
+	for _, next := range orderTransitions[o.State] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Move records a transition; callers check CanMove first.
+func (o *Order) Move(to OrderState, by string) {
+	o.State = to
+	o.History = append(o.History, OrderTransition{State: to, By: by, At: time.Now().UnixNano()})
+}
+
+type OrderRepository interface {
+	Add(Order) (Order, error)
+	Get(id int) (Order, error)
+	Update(Order) error
+	// Transition moves an order to a state if check allows it, as one step,
+	// so two concurrent moves can't both start from the same state.
+	Transition(id int, to OrderState, by string, check func(Order) error) (Order, error)
+	List() []Order
+	ListByEmail(email string) []Order
+}
+
+type InMemoryOrderStorage struct {
+	lock   sync.RWMutex
+	orders map[int]Order
+	lastID int
+}
+
+func NewInMemoryOrderStorage() *InMemoryOrderStorage {
+	return &InMemoryOrderStorage{
+		orders: make(map[int]Order),
+	}
+}
+
+// Add stores a new order under the next free id.
+func (s *InMemoryOrderStorage) Add(order Order) (Order, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastID++
+	order.ID = s.lastID
+	s.orders[order.ID] = order
+	return order, nil
+}
+
+func (s *InMemoryOrderStorage) Get(id int) (Order, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return Order{}, errors.New("order " + strconv.Itoa(id) + " not found")
+	}
+	return order, nil
+}
+
+func (s *InMemoryOrderStorage) Update(order Order) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.orders[order.ID]; !ok {
+		return errors.New("order " + strconv.Itoa(order.ID) + " not found")
+	}
+	s.orders[order.ID] = order
+	return nil
+}
+
+func (s *InMemoryOrderStorage) Transition(id int, to OrderState, by string, check func(Order) error) (Order, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return Order{}, errors.New("order " + strconv.Itoa(id) + " not found")
+	}
+	if err := check(order); err != nil {
+		return Order{}, err
+	}
+	// History is appended to, so the stored order must not share its array.
+	order.History = append([]OrderTransition(nil), order.History...)
+	order.Move(to, by)
+	s.orders[id] = order
+	return order, nil
+}
+
+// List returns all orders, the oldest first.
+func (s *InMemoryOrderStorage) List() []Order {
+	return s.list(func(Order) bool { return true })
+}
+
+func (s *InMemoryOrderStorage) ListByEmail(email string) []Order {
+	return s.list(func(order Order) bool { return order.Email == email })
+}
+
+func (s *InMemoryOrderStorage) list(match func(Order) bool) []Order {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	orders := []Order{}
+	for _, order := range s.orders {
+		if match(order) {
+			orders = append(orders, order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
+}
+
+// moveOrders keeps the orders of a renamed account attributed to it.
+func (s *UserService) moveOrders(from, to string) error {
+	for _, order := range s.orders.ListByEmail(from) {
+		order.Email = to
+		if err := s.orders.Update(order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *UserService) describeOrder(order Order) string {
+	return "order " + strconv.Itoa(order.ID) + " (" + strconv.Itoa(order.Quantity) + " x " + s.cakeName(order.CakeID) + ")"
+}
+
+// publishOrder lets the customer follow the status of an order live.
+func (s *UserService) publishOrder(order Order) {
+	s.notifier <- userEvent(order.Email, s.describeOrder(order)+" is "+string(order.State))
+}
+
+func (s *UserService) formatOrder(order Order) string {
+	line := strconv.Itoa(order.ID) + ": " + strconv.Itoa(order.Quantity) + " x " + s.cakeName(order.CakeID) + " " + string(order.State)
+	if order.Note != "" {
+		line += " - " + order.Note
+	}
+	return line
+}
+
+func orderID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, errors.New("invalid order id")
+	}
+	return id, nil
+}
+
+type OrderParams struct {
+	Cake     string `json:"cake"`
+	Quantity int    `json:"quantity"`
+	Note     string `json:"note"`
+	State    string `json:"state"`
+}
+
+func (s *UserService) placeOrderHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &OrderParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	cake, err := s.resolveCake(params.Cake)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if params.Quantity == 0 {
+		params.Quantity = 1
+	}
+	if params.Quantity < 0 || params.Quantity > orderMaxQuantity {
+		handleError(errors.New("quantity must be from 1 to "+strconv.Itoa(orderMaxQuantity)), w)
+		return
+	}
+
+	params.Note = strings.TrimSpace(params.Note)
+	if utf8.RuneCountInString(params.Note) > orderNoteMaxLength {
+		handleError(errors.New("note too long"), w)
+		return
+	}
+
+	order := Order{
+		Email:    u.Email,
+		CakeID:   cake.ID,
+		Quantity: params.Quantity,
+		Note:     params.Note,
+		PlacedAt: time.Now().UnixNano(),
+	}
+	order.Move(orderPlaced, u.Email)
+
+	order, err = s.orders.Add(order)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusCreated, "order "+strconv.Itoa(order.ID)+" placed")
+	s.publishOrder(order)
+}
+
+func (s *UserService) listOrdersHandler(w http.ResponseWriter, r *http.Request, u User) {
+	orders := s.orders.ListByEmail(u.Email)
+	if len(orders) == 0 {
+		writeResponse(w, http.StatusOK, "you have no orders")
+		return
+	}
+
+	lines := make([]string, len(orders))
+	for i, order := range orders {
+		lines[i] = s.formatOrder(order)
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+// cancelOrderHandler lets customers take back an order nobody started
+// baking yet.
+func (s *UserService) cancelOrderHandler(w http.ResponseWriter, r *http.Request, u User) {
+	id, err := orderID(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	order, err := s.orders.Transition(id, orderCancelled, u.Email, func(order Order) error {
+		if order.Email != u.Email {
+			return errors.New("order " + strconv.Itoa(id) + " not found")
+		}
+		if order.State != orderPlaced {
+			return errors.New("order " + strconv.Itoa(id) + " is already " + string(order.State))
+		}
+		return nil
+	})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "order "+strconv.Itoa(id)+" cancelled")
+	s.publishOrder(order)
+}
+
+func (s *UserService) adminListOrdersHandler(w http.ResponseWriter, r *http.Request, u User) {
+	var state OrderState
+	if value := r.URL.Query().Get("state"); value != "" {
+		var err error
+		if state, err = parseOrderState(value); err != nil {
+			handleError(err, w)
+			return
+		}
+	}
+
+	lines := []string{}
+	for _, order := range s.orders.List() {
+		if state == "" || order.State == state {
+			lines = append(lines, order.Email+" "+s.formatOrder(order))
+		}
+	}
+	if len(lines) == 0 {
+		writeResponse(w, http.StatusOK, "there are no orders")
+		return
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+// moveOrderHandler drives an order through its states as the bakery works
+// on it.
+func (s *UserService) moveOrderHandler(w http.ResponseWriter, r *http.Request, u User) {
+	id, err := orderID(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	params := &OrderParams{}
+	err = json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	state, err := parseOrderState(params.State)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	order, err := s.orders.Transition(id, state, u.Email, func(order Order) error {
+		if !order.CanMove(state) {
+			return errors.New("order " + strconv.Itoa(id) + " can't go from " + string(order.State) + " to " + string(state))
+		}
+		return nil
+	})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "order "+strconv.Itoa(id)+" is "+string(state)+" now")
+	s.publishOrder(order)
+	if state == orderDelivered {
+		cakesGiven.Add(float64(order.Quantity))
+	}
+}
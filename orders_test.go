@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCakeOrders(t *testing.T) {
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	orders := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.placeOrderHandler))))
+	lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.listOrdersHandler))))
+	cancels := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.cancelOrderHandler))))
+	adminLists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permOrdersManage, u.adminListOrdersHandler))))
+	moves := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permOrdersManage, u.moveOrderHandler))))
+	defer func() {
+		orders.Close()
+		lists.Close()
+		cancels.Close()
+		adminLists.Close()
+		moves.Close()
+	}()
+
+	user := newUser()
+	u.repository.Add(user.Email, user)
+	other := newUser()
+	u.repository.Add(other.Email, other)
+	admin := newAdmin()
+	u.repository.Add(admin.Email, admin)
+
+	send := createSender(t, j)
+
+	resp := send(http.MethodPost, orders.URL, user, Params{"cake": "napoleon", "quantity": 21})
+	assertResponse(t, 422, "quantity must be from 1 to 20", resp)
+
+	resp = send(http.MethodPost, orders.URL, user, Params{"cake": "Millefeuille", "quantity": 2, "note": "for friday"})
+	assertResponse(t, http.StatusCreated, "order 1 placed", resp)
+	expectEvent(t, u, "@"+user.Email+" order 1 (2 x napoleon) is placed")
+
+	resp = send(http.MethodPost, orders.URL, user, Params{"cake": "brownie"})
+	assertResponse(t, http.StatusCreated, "order 2 placed", resp)
+	expectEvent(t, u, "@"+user.Email+" order 2 (1 x brownie) is placed")
+
+	resp = send(http.MethodPost, moves.URL+"/1", user, Params{"state": "baking"})
+	assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+	resp = send(http.MethodPost, moves.URL+"/1", admin, Params{"state": "ready"})
+	assertResponse(t, 422, "order 1 can't go from placed to ready", resp)
+
+	resp = send(http.MethodPost, moves.URL+"/1", admin, Params{"state": "burnt"})
+	assertResponse(t, 422, "unknown order state burnt", resp)
+
+	for _, state := range []string{"baking", "ready", "delivered"} {
+		resp = send(http.MethodPost, moves.URL+"/1", admin, Params{"state": state})
+		assertResponse(t, http.StatusOK, "order 1 is "+state+" now", resp)
+		expectEvent(t, u, "@"+user.Email+" order 1 (2 x napoleon) is "+state)
+	}
+
+	resp = send(http.MethodPost, moves.URL+"/1", admin, Params{"state": "cancelled"})
+	assertResponse(t, 422, "order 1 can't go from delivered to cancelled", resp)
+
+	resp = send(http.MethodPost, cancels.URL+"/2", other, nil)
+	assertResponse(t, 422, "order 2 not found", resp)
+
+	resp = send(http.MethodPost, cancels.URL+"/1", user, nil)
+	assertResponse(t, 422, "order 1 is already delivered", resp)
+
+	resp = send(http.MethodPost, cancels.URL+"/2", user, nil)
+	assertResponse(t, http.StatusOK, "order 2 cancelled", resp)
+	expectEvent(t, u, "@"+user.Email+" order 2 (1 x brownie) is cancelled")
+
+	resp = send(http.MethodGet, lists.URL, user, nil)
+	assertResponse(t, http.StatusOK, "1: 2 x napoleon delivered - for friday\n2: 1 x brownie cancelled", resp)
+
+	resp = send(http.MethodGet, lists.URL, other, nil)
+	assertResponse(t, http.StatusOK, "you have no orders", resp)
+
+	resp = send(http.MethodGet, adminLists.URL+"?state=cancelled", admin, nil)
+	assertResponse(t, http.StatusOK, user.Email+" 2: 1 x brownie cancelled", resp)
+
+	order, _ := u.orders.Get(1)
+	if len(order.History) != 4 || order.History[3].By != admin.Email {
+		t.Errorf("Unexpected order history %v", order.History)
+	}
+}
+
+func TestOrderTransitionIsAtomic(t *testing.T) {
+	orders := NewInMemoryOrderStorage()
+	order, _ := orders.Add(Order{Email: "customer@mail.com", CakeID: "napoleon", Quantity: 1, State: orderPlaced})
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	moved := 0
+	for _, state := range []OrderState{orderBaking, orderCancelled, orderBaking, orderCancelled} {
+		wg.Add(1)
+		go func(state OrderState) {
+			defer wg.Done()
+			_, err := orders.Transition(order.ID, state, "admin@mail.com", func(o Order) error {
+				if o.State != orderPlaced {
+					return errors.New("already moved")
+				}
+				return nil
+			})
+			if err == nil {
+				lock.Lock()
+				moved++
+				lock.Unlock()
+			}
+		}(state)
+	}
+	wg.Wait()
+
+	order, _ = orders.Get(order.ID)
+	if moved != 1 || len(order.History) != 1 {
+		t.Errorf("Expected exactly one transition but got %d, history %v", moved, order.History)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordsList string
+
+var commonPasswords = func() map[string]bool {
+	passwords := map[string]bool{}
+	for _, p := range strings.Fields(commonPasswordsList) {
+		passwords[strings.ToLower(p)] = true
+	}
+	return passwords
+}()
+
+type PasswordPolicy struct {
+	cfg config.PasswordConfig
+}
+
+func NewPasswordPolicy(cfg config.PasswordConfig) PasswordPolicy {
+	return PasswordPolicy{cfg: cfg}
+}
+
+func (p PasswordPolicy) Validate(password string, email string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.cfg.MinLength {
+		return errors.New("password too short")
+	}
+	if p.cfg.MaxLength > 0 && length > p.cfg.MaxLength {
+		return errors.New("password too long")
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	switch {
+	case p.cfg.RequireLower && !lower:
+		return errors.New("password must contain a lowercase letter")
+	case p.cfg.RequireUpper && !upper:
+		return errors.New("password must contain an uppercase letter")
+	case p.cfg.RequireDigit && !digit:
+		return errors.New("password must contain a digit")
+	case p.cfg.RequireSymbol && !symbol:
+		return errors.New("password must contain a symbol")
+	}
+
+	if p.cfg.RejectCommon && commonPasswords[strings.ToLower(password)] {
+		return errors.New("password is too common")
+	}
+
+	if p.cfg.RejectEmailLocal && email != "" {
+		local := strings.ToLower(strings.Split(email, "@")[0])
+		if local != "" && strings.Contains(strings.ToLower(password), local) {
+			return errors.New("password must not contain email")
+		}
+	}
+
+	return nil
+}
+
+func (p PasswordPolicy) CheckHistory(u User, passwordDigest string) error {
+	if p.cfg.History <= 0 {
+		return nil
+	}
+
+	if passwordDigest == u.PasswordDigest {
+		return errors.New("password was used recently, choose one not among last " + strconv.Itoa(p.cfg.History))
+	}
+
+	if u.PasswordHistory == nil {
+		return nil
+	}
+
+	history := *u.PasswordHistory
+	for i := len(history) - 1; i >= 0 && i >= len(history)-(p.cfg.History-1); i-- {
+		if history[i] == passwordDigest {
+			return errors.New("password was used recently, choose one not among last " + strconv.Itoa(p.cfg.History))
+		}
+	}
+
+	return nil
+}
+
+// RememberPassword moves the current digest into the history before it is
+// replaced, keeping only as many entries as the policy checks.
+func (p PasswordPolicy) RememberPassword(u *User) {
+	if p.cfg.History <= 1 || u.PasswordDigest == "" {
+		return
+	}
+
+	history := []string{}
+	if u.PasswordHistory != nil {
+		history = append(history, *u.PasswordHistory...)
+	}
+	history = append(history, u.PasswordDigest)
+	if len(history) > p.cfg.History-1 {
+		history = history[len(history)-(p.cfg.History-1):]
+	}
+
+	u.PasswordHistory = &history
+}
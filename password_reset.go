@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type PasswordReset struct {
+	Email       string
+	TokenDigest string
+	CreatedAt   int64
+	ExpiresAt   int64
+}
+
+type PasswordResetRepository interface {
+	Add(PasswordReset) error
+	Get(tokenDigest string) (PasswordReset, error)
+	Take(tokenDigest string) (PasswordReset, error)
+	Last(email string) (PasswordReset, bool)
+}
+
+type InMemoryPasswordResetStorage struct {
+	lock    sync.Mutex
+	byToken map[string]PasswordReset
+	byEmail map[string]string
+}
+
+func NewInMemoryPasswordResetStorage() *InMemoryPasswordResetStorage {
+	return &InMemoryPasswordResetStorage{
+		byToken: make(map[string]PasswordReset),
+		byEmail: make(map[string]string),
+	}
+}
+
+// Add replaces any reset still pending for the same email, so only the
+// latest link works.
+func (s *InMemoryPasswordResetStorage) Add(reset PasswordReset) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if previous, ok := s.byEmail[reset.Email]; ok {
+		delete(s.byToken, previous)
+	}
+
+	s.byToken[reset.TokenDigest] = reset
+	s.byEmail[reset.Email] = reset.TokenDigest
+	return nil
+}
+
+func (s *InMemoryPasswordResetStorage) Get(tokenDigest string) (PasswordReset, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reset, ok := s.byToken[tokenDigest]
+	if !ok {
+		return PasswordReset{}, errors.New("invalid or expired token")
+	}
+	return reset, nil
+}
+
+func (s *InMemoryPasswordResetStorage) Take(tokenDigest string) (PasswordReset, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reset, ok := s.byToken[tokenDigest]
+	if !ok {
+		return PasswordReset{}, errors.New("invalid or expired token")
+	}
+
+	delete(s.byToken, tokenDigest)
+	delete(s.byEmail, reset.Email)
+	return reset, nil
+}
+
+func (s *InMemoryPasswordResetStorage) Last(email string) (PasswordReset, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reset, ok := s.byToken[s.byEmail[email]]
+	return reset, ok
+}
+
+type PasswordResetParams struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (s *UserService) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := readParams(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	email, err := s.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err := s.requestPasswordReset(email); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "if the account exists, a reset link has been sent")
+}
+
+func (s *UserService) requestPasswordReset(email string) error {
+	user, err := s.repository.Get(email)
+	if err != nil || UserHasBan(user) {
+		return nil
+	}
+
+	now := time.Now()
+	if last, ok := s.resets.Last(user.Email); ok &&
+		now.Before(time.Unix(0, last.CreatedAt).Add(time.Duration(s.emailCfg.ResendInterval))) {
+		return nil
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	expires := now.Add(time.Duration(s.emailCfg.ResetTTL))
+	err = s.resets.Add(PasswordReset{
+		Email:       user.Email,
+		TokenDigest: hashToken(token),
+		CreatedAt:   now.UnixNano(),
+		ExpiresAt:   expires.UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.sendMail(user.Email, "Reset your password",
+		"Open "+s.link("/user/password/reset", token)+" to check the link, then send your new password as "+
+			"{\"password\": \"...\"} in a POST request to the same link. The link is valid until "+
+			expires.UTC().Format(time.RFC1123)+". If you did not ask for it, ignore this email.")
+}
+
+// ResetPasswordHandler takes the token from the mailed link or the params.
+// Opening the link only checks the token; posting a password to it resets.
+func (s *UserService) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	params := &PasswordResetParams{}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+			handleError(errors.New("could not read params"), w)
+			return
+		}
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		params.Token = token
+	}
+
+	// The token is only used up once the new password is accepted, so a
+	// rejected password does not burn the link.
+	reset, err := s.resets.Get(hashToken(params.Token))
+	if err != nil || time.Now().UnixNano() > reset.ExpiresAt {
+		handleError(errors.New("invalid or expired token"), w)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeResponse(w, http.StatusOK, "the link is valid, post your new password to it")
+		return
+	}
+
+	user, err := s.repository.Get(reset.Email)
+	if err != nil {
+		handleError(errors.New("invalid or expired token"), w)
+		return
+	}
+
+	if err := s.passwords.Validate(params.Password, user.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	passwordDigest := string(md5.New().Sum([]byte(params.Password)))
+	if err := s.passwords.CheckHistory(user, passwordDigest); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if _, err := s.resets.Take(reset.TokenDigest); err != nil {
+		handleError(errors.New("invalid or expired token"), w)
+		return
+	}
+
+	s.passwords.RememberPassword(&user)
+	user.PasswordDigest = passwordDigest
+	user.MustChangePassword = false
+	user.PendingVerification = false
+	user.VerificationNonce = ""
+	user.FailedLogins = 0
+	user.LockedUntil = 0
+
+	err = s.repository.Update(user.Email, user)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	s.endSessions(user.Email)
+
+	writeResponse(w, http.StatusOK, "password reset")
+	s.notifier <- []byte("password reset: " + user.Email)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+)
+
+type Permission string
+
+const (
+	permUsersBan         Permission = "users.ban"
+	permUsersPromote     Permission = "users.promote"
+	permUsersInspect     Permission = "users.inspect"
+	permUsersSessions    Permission = "users.sessions"
+	permUsersImpersonate Permission = "users.impersonate"
+	permUsersInvite      Permission = "users.invite"
+	permDomainsManage    Permission = "domains.manage"
+	permCakesManage      Permission = "cakes.manage"
+	permOrdersManage     Permission = "orders.manage"
+
+	permProfileRead  Permission = "profile.read"
+	permProfileWrite Permission = "profile.write"
+	permAccount      Permission = "account.manage"
+)
+
+// selfPermissions are granted to every role for its own account and need
+// not be listed in the policy. permAccount guards credentials, so api keys
+// can never be scoped to it.
+var selfPermissions = []Permission{permProfileRead, permProfileWrite, permAccount}
+
+func isSelfPermission(perm Permission) bool {
+	for _, p := range selfPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+type RolePolicy struct {
+	Permissions      []Permission `json:"permissions"`
+	Manages          []Role       `json:"manages"`
+	RequireTwoFactor bool         `json:"require_2fa"`
+}
+
+type Policy struct {
+	roles map[Role]RolePolicy
+}
+
+func NewPolicy(roles map[Role]RolePolicy) *Policy {
+	return &Policy{roles: roles}
+}
+
+func DefaultPolicy() *Policy {
+	return NewPolicy(map[Role]RolePolicy{
+		userRole: {},
+		adminRole: {
+			Permissions:      []Permission{permUsersBan, permUsersInspect, permUsersSessions, permCakesManage, permOrdersManage},
+			Manages:          []Role{userRole},
+			RequireTwoFactor: true,
+		},
+		superadminRole: {
+			Permissions:      []Permission{permUsersBan, permUsersInspect, permUsersSessions, permUsersPromote, permUsersImpersonate, permUsersInvite, permDomainsManage, permCakesManage, permOrdersManage},
+			Manages:          []Role{userRole, adminRole},
+			RequireTwoFactor: true,
+		},
+	})
+}
+
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := map[Role]RolePolicy{}
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, err
+	}
+
+	if _, ok := roles[userRole]; !ok {
+		return nil, errors.New("policy must define '" + userRole.String() + "' role")
+	}
+
+	for role, rp := range roles {
+		for _, managed := range rp.Manages {
+			if _, ok := roles[managed]; !ok {
+				return nil, errors.New("role " + role.String() + " manages undefined role " + managed.String())
+			}
+		}
+	}
+
+	return NewPolicy(roles), nil
+}
+
+func (p *Policy) HasRole(r Role) bool {
+	_, ok := p.roles[r]
+	return ok
+}
+
+func (p *Policy) Can(r Role, perm Permission) bool {
+	if isSelfPermission(perm) {
+		return p.HasRole(r)
+	}
+	for _, granted := range p.roles[r].Permissions {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// superadminOnly tells whether no role but superadmin holds perm. Denials of
+// such permissions keep the message the superadmin api always answered with.
+func (p *Policy) superadminOnly(perm Permission) bool {
+	if isSelfPermission(perm) {
+		return false
+	}
+	for role := range p.roles {
+		if role != superadminRole && p.Can(role, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Policy) CanManage(actor Role, target Role) bool {
+	for _, managed := range p.roles[actor].Manages {
+		if managed == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) RequiresTwoFactor(r Role) bool {
+	return p.roles[r].RequireTwoFactor
+}
+
+func (p *Policy) Require(perm Permission, h ProtectedHandler) ProtectedHandler {
+	return func(w http.ResponseWriter, r *http.Request, u User) {
+		if !p.Can(u.Role, perm) {
+			if p.superadminOnly(perm) {
+				writeResponse(w, 401, "try to acces superadmin api without superadmin rights")
+				return
+			}
+			writeResponse(w, 401, "not enough rights to performe this action")
+			return
+		}
+		if _, ok := impersonatorFromContext(r.Context()); ok && perm == permAccount {
+			writeResponse(w, 401, "action is not allowed while impersonating")
+			return
+		}
+		if key, ok := apiKeyFromContext(r.Context()); ok && !key.HasScope(perm) {
+			writeResponse(w, 401, "api key is not scoped to "+string(perm))
+			return
+		}
+		if !isSelfPermission(perm) && p.RequiresTwoFactor(u.Role) && !u.TOTPEnabled {
+			writeResponse(w, 401, "two-factor authentication is required for role "+u.Role.String())
+			return
+		}
+		h(w, r, u)
+	}
+}
@@ -18,6 +18,10 @@ var (
 		Name: "number_of_cakes_given",
 		Help: "The total number of given cakes.",
 	})
+	throttledLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_throttled_logins",
+		Help: "The total number of login attempts rejected by rate limiting or lockout.",
+	}, []string{"reason"})
 	requestRecords = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "api_request_record_seconds",
 		Help:    "Histogram of response time for handler in seconds.",
@@ -25,7 +29,7 @@ var (
 	}, []string{"path"})
 )
 
-func startProm() {
+func startProm(addr string) {
 	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":2112", nil)
+	http.ListenAndServe(addr, nil)
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+)
+
+const maxTrackedBuckets = 10000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func NewRateLimiter(perMinute float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxTrackedBuckets {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type LoginLimiter struct {
+	ip      *RateLimiter
+	account *RateLimiter
+
+	// normalize maps the spellings of an email onto one account bucket.
+	normalize func(string) (string, error)
+}
+
+func NewLoginLimiter(cfg config.LoginConfig) *LoginLimiter {
+	return &LoginLimiter{
+		ip:      NewRateLimiter(cfg.IPRate, cfg.IPBurst),
+		account: NewRateLimiter(cfg.AccountRate, cfg.AccountBurst),
+	}
+}
+
+func (l *LoginLimiter) Limit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.ip.Allow(clientIP(r)); !ok {
+			throttledLogins.WithLabelValues("ip").Inc()
+			writeTooManyRequests(w, wait, "too many login attempts, try again later")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		params := &JWTParams{}
+		if json.Unmarshal(body, params) == nil && params.Email != "" {
+			if l.normalize != nil {
+				if email, err := l.normalize(params.Email); err == nil {
+					params.Email = email
+				}
+			}
+			if ok, wait := l.account.Allow(params.Email); !ok {
+				throttledLogins.WithLabelValues("account").Inc()
+				writeTooManyRequests(w, wait, "too many login attempts, try again later")
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
+
+type LockoutPolicy struct {
+	MaxFailedLogins int
+	Base            time.Duration
+	Max             time.Duration
+}
+
+func NewLockoutPolicy(cfg config.LoginConfig) LockoutPolicy {
+	return LockoutPolicy{
+		MaxFailedLogins: cfg.MaxFailedLogins,
+		Base:            time.Duration(cfg.LockoutBase),
+		Max:             time.Duration(cfg.LockoutMax),
+	}
+}
+
+// lockoutFor doubles the lockout for every failure past the threshold.
+func (p LockoutPolicy) lockoutFor(failedLogins int) time.Duration {
+	if p.MaxFailedLogins <= 0 || failedLogins < p.MaxFailedLogins {
+		return 0
+	}
+
+	lockout := p.Base
+	for i := p.MaxFailedLogins; i < failedLogins && lockout < p.Max; i++ {
+		lockout *= 2
+	}
+	if lockout > p.Max {
+		lockout = p.Max
+	}
+	return lockout
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration, response string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeResponse(w, http.StatusTooManyRequests, response)
+}
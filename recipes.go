@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	recipeMaxIngredients = 100
+	recipeMaxSteps       = 100
+	recipeStepMaxLength  = 1000
+	recipeMaxYield       = 1000
+)
+
+type Ingredient struct {
+	Name     string  `json:"name"`
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"`
+}
+
+type Recipe struct {
+	Ingredients []Ingredient `json:"ingredients"`
+	Steps       []string     `json:"steps"`
+	Yield       int          `json:"yield"`
+}
+
+type RecipeRevision struct {
+	Recipe
+	Version int
+	Author  string
+	At      int64
+}
+
+// unit describes how much of the base unit of its kind (grams for mass,
+// milliliters for volume) one unit is. Units without a kind, like pieces,
+// read the same in both systems.
+type unit struct {
+	kind string
+	base float64
+}
+
+var units = map[string]unit{
+	"g":     {"mass", 1},
+	"kg":    {"mass", 1000},
+	"oz":    {"mass", 28.349523125},
+	"lb":    {"mass", 453.59237},
+	"ml":    {"volume", 1},
+	"l":     {"volume", 1000},
+	"fl-oz": {"volume", 29.5735295625},
+	"cup":   {"volume", 236.5882365},
+	"tsp":   {"volume", 4.92892159375},
+	"tbsp":  {"volume", 14.78676478125},
+	"pcs":   {},
+}
+
+// unitLadders lists the units each kind is written in by each system,
+// smallest first.
+var unitLadders = map[string]map[string][]string{
+	"mass": {
+		"metric":   {"g", "kg"},
+		"imperial": {"oz", "lb"},
+	},
+	"volume": {
+		"metric":   {"ml", "l"},
+		"imperial": {"tsp", "tbsp", "fl-oz", "cup"},
+	},
+}
+
+// convertQuantity expresses a quantity in the given system, in the largest
+// unit of which there is at least one.
+func convertQuantity(quantity float64, unitName, system string) (float64, string) {
+	from := units[unitName]
+	if from.kind == "" || system == "" {
+		return quantity, unitName
+	}
+
+	base := quantity * from.base
+	ladder := unitLadders[from.kind][system]
+	to := ladder[0]
+	for _, name := range ladder[1:] {
+		if base/units[name].base >= 1 {
+			to = name
+		}
+	}
+	return base / units[to].base, to
+}
+
+func formatQuantity(quantity float64) string {
+	return strconv.FormatFloat(math.Round(quantity*100)/100, 'f', -1, 64)
+}
+
+func formatIngredient(ingredient Ingredient) string {
+	if ingredient.Unit == "" {
+		return formatQuantity(ingredient.Quantity) + " " + ingredient.Name
+	}
+	return formatQuantity(ingredient.Quantity) + " " + ingredient.Unit + " " + ingredient.Name
+}
+
+// Scaled returns the recipe for the given yield in the given units system;
+// an empty system keeps the units as written.
+func (r Recipe) Scaled(yield int, system string) Recipe {
+	scaled := Recipe{Steps: r.Steps, Yield: yield}
+	for _, ingredient := range r.Ingredients {
+		quantity := ingredient.Quantity * float64(yield) / float64(r.Yield)
+		quantity, ingredient.Unit = convertQuantity(quantity, ingredient.Unit, system)
+		ingredient.Quantity = quantity
+		scaled.Ingredients = append(scaled.Ingredients, ingredient)
+	}
+	return scaled
+}
+
+// Lines are the recipe as shown to users and compared between revisions.
+func (r Recipe) Lines() []string {
+	lines := []string{"serves " + strconv.Itoa(r.Yield), "ingredients:"}
+	for _, ingredient := range r.Ingredients {
+		lines = append(lines, "- "+formatIngredient(ingredient))
+	}
+	lines = append(lines, "steps:")
+	for i, step := range r.Steps {
+		lines = append(lines, strconv.Itoa(i+1)+". "+step)
+	}
+	return lines
+}
+
+func validateRecipe(r *Recipe) error {
+	if len(r.Ingredients) == 0 || len(r.Ingredients) > recipeMaxIngredients {
+		return errors.New("a recipe must have from 1 to " + strconv.Itoa(recipeMaxIngredients) + " ingredients")
+	}
+	for i, ingredient := range r.Ingredients {
+		ingredient.Name = strings.Join(strings.Fields(ingredient.Name), " ")
+		ingredient.Unit = strings.ToLower(strings.TrimSpace(ingredient.Unit))
+		if ingredient.Name == "" {
+			return errors.New("ingredient name can't be empty")
+		}
+		if ingredient.Quantity <= 0 {
+			return errors.New("quantity of " + ingredient.Name + " must be positive")
+		}
+		if _, ok := units[ingredient.Unit]; !ok && ingredient.Unit != "" {
+			return errors.New("unknown unit " + ingredient.Unit)
+		}
+		r.Ingredients[i] = ingredient
+	}
+
+	if len(r.Steps) == 0 || len(r.Steps) > recipeMaxSteps {
+		return errors.New("a recipe must have from 1 to " + strconv.Itoa(recipeMaxSteps) + " steps")
+	}
+	for i, step := range r.Steps {
+		r.Steps[i] = strings.TrimSpace(step)
+		if r.Steps[i] == "" {
+			return errors.New("step " + strconv.Itoa(i+1) + " can't be empty")
+		}
+		if utf8.RuneCountInString(r.Steps[i]) > recipeStepMaxLength {
+			return errors.New("step " + strconv.Itoa(i+1) + " too long")
+		}
+	}
+
+	if r.Yield < 1 || r.Yield > recipeMaxYield {
+		return errors.New("yield must be from 1 to " + strconv.Itoa(recipeMaxYield))
+	}
+	return nil
+}
+
+// diffLines returns the lines removed from a, prefixed with "- ", and added
+// in b, prefixed with "+ ", in the order they appear.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = lcs[i+1][j]
+				if lcs[i][j+1] > lcs[i][j] {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+	}
+
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+type RecipeRepository interface {
+	Add(cakeID string, revision RecipeRevision) (RecipeRevision, error)
+	Get(cakeID string, version int) (RecipeRevision, error)
+	History(cakeID string) []RecipeRevision
+	Delete(cakeID string) error
+}
+
+type InMemoryRecipeStorage struct {
+	lock    sync.RWMutex
+	recipes map[string][]RecipeRevision
+}
+
+func NewInMemoryRecipeStorage() *InMemoryRecipeStorage {
+	return &InMemoryRecipeStorage{
+		recipes: make(map[string][]RecipeRevision),
+	}
+}
+
+// Add stores a revision as the next version of the recipe of a cake.
+func (s *InMemoryRecipeStorage) Add(cakeID string, revision RecipeRevision) (RecipeRevision, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	revision.Version = len(s.recipes[cakeID]) + 1
+	s.recipes[cakeID] = append(s.recipes[cakeID], revision)
+	return revision, nil
+}
+
+// Get returns a version of the recipe of a cake, the latest one for 0.
+func (s *InMemoryRecipeStorage) Get(cakeID string, version int) (RecipeRevision, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	revisions := s.recipes[cakeID]
+	if len(revisions) == 0 {
+		return RecipeRevision{}, errors.New("cake " + cakeID + " does not have a recipe")
+	}
+	if version == 0 {
+		version = len(revisions)
+	}
+	if version < 1 || version > len(revisions) {
+		return RecipeRevision{}, errors.New("version must be from 1 to " + strconv.Itoa(len(revisions)))
+	}
+	return revisions[version-1], nil
+}
+
+func (s *InMemoryRecipeStorage) History(cakeID string) []RecipeRevision {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]RecipeRevision{}, s.recipes[cakeID]...)
+}
+
+func (s *InMemoryRecipeStorage) Delete(cakeID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.recipes[cakeID]; !ok {
+		return errors.New("cake " + cakeID + " does not have a recipe")
+	}
+	delete(s.recipes, cakeID)
+	return nil
+}
+
+func queryVersion(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, errors.New(name + " must be a version number")
+	}
+	return version, nil
+}
+
+func (s *UserService) saveRecipeHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cake, err := s.cakes.Get(mux.Vars(r)["id"])
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	recipe := &Recipe{}
+	if err := json.NewDecoder(r.Body).Decode(recipe); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if err := validateRecipe(recipe); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	revision, err := s.recipes.Add(cake.ID, RecipeRevision{
+		Recipe: *recipe,
+		Author: u.Email,
+		At:     s.clock().UnixNano(),
+	})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	version := strconv.Itoa(revision.Version)
+	writeResponse(w, http.StatusCreated, "recipe of "+cake.Name+" saved as v"+version)
+	s.notifier <- []byte("recipe updated: " + cake.ID + " v" + version + " by " + u.Email)
+}
+
+// recipeHandler shows a recipe, optionally scaled to another yield and
+// converted to metric or imperial units.
+func (s *UserService) recipeHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cake, err := s.resolveCake(r.URL.Query().Get("cake"))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	version, err := queryVersion(r, "version")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	system := r.URL.Query().Get("units")
+	if system != "" && system != "metric" && system != "imperial" {
+		handleError(errors.New("units must be metric or imperial"), w)
+		return
+	}
+
+	revision, err := s.recipes.Get(cake.ID, version)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	yield, err := queryInt(r, "servings", revision.Yield, recipeMaxYield)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	lines := []string{cake.Name + " v" + strconv.Itoa(revision.Version) + " by " + revision.Author}
+	lines = append(lines, revision.Scaled(yield, system).Lines()...)
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+func (s *UserService) recipeHistoryHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cake, err := s.resolveCake(r.URL.Query().Get("cake"))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	revisions := s.recipes.History(cake.ID)
+	if len(revisions) == 0 {
+		handleError(errors.New("cake "+cake.ID+" does not have a recipe"), w)
+		return
+	}
+
+	lines := []string{}
+	for _, revision := range revisions {
+		lines = append(lines, "v"+strconv.Itoa(revision.Version)+" "+
+			time.Unix(0, revision.At).UTC().Format(time.RFC3339)+" by "+revision.Author)
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+// recipeDiffHandler compares two versions of a recipe, by default the
+// latest one with the version before it.
+func (s *UserService) recipeDiffHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cake, err := s.resolveCake(r.URL.Query().Get("cake"))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	to, err := queryVersion(r, "to")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	newer, err := s.recipes.Get(cake.ID, to)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	from, err := queryVersion(r, "from")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if from == 0 {
+		from = newer.Version - 1
+		if from == 0 {
+			from = 1
+		}
+	}
+	older, err := s.recipes.Get(cake.ID, from)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	lines := []string{"v" + strconv.Itoa(older.Version) + " -> v" + strconv.Itoa(newer.Version) + ":"}
+	diff := diffLines(older.Lines(), newer.Lines())
+	if len(diff) == 0 {
+		diff = []string{"no changes"}
+	}
+	writeResponse(w, http.StatusOK, strings.Join(append(lines, diff...), "\n"))
+}
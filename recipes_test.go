@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecipes(t *testing.T) {
+	u := newTestUserService()
+	j := newTestJwtService(t)
+	u.clock = func() time.Time { return time.Date(2026, time.March, 14, 10, 0, 0, 0, time.UTC) }
+
+	saves := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permCakesManage, u.saveRecipeHandler))))
+	recipes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.recipeHandler))))
+	histories := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.recipeHistoryHandler))))
+	diffs := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.recipeDiffHandler))))
+	defer func() {
+		saves.Close()
+		recipes.Close()
+		histories.Close()
+		diffs.Close()
+	}()
+
+	user := newUser()
+	u.repository.Add(user.Email, user)
+	admin := newAdmin()
+	u.repository.Add(admin.Email, admin)
+
+	sendAs := createSender(t, j)
+	send := func(method, url string, actor User, params Params) parsedResponse {
+		resp := sendAs(method, url, actor, params)
+		if method == http.MethodPut && resp.status == http.StatusCreated {
+			<-u.notifier
+		}
+		return resp
+	}
+
+	recipe := func(flour float64, steps ...string) Params {
+		return Params{
+			"ingredients": []Params{
+				{"name": "flour", "quantity": flour, "unit": "g"},
+				{"name": "milk", "quantity": 250, "unit": "ML"},
+				{"name": "eggs", "quantity": 3, "unit": "pcs"},
+				{"name": "vanilla", "quantity": 1, "unit": "tsp"},
+			},
+			"steps": steps,
+			"yield": 8,
+		}
+	}
+
+	resp := send(http.MethodGet, recipes.URL+"?cake=napoleon", user, nil)
+	assertResponse(t, 422, "cake napoleon does not have a recipe", resp)
+
+	resp = send(http.MethodPut, saves.URL+"/napoleon", user, recipe(500, "bake"))
+	assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+	resp = send(http.MethodPut, saves.URL+"/napoleon", admin, Params{
+		"ingredients": []Params{{"name": "flour", "quantity": 1, "unit": "pinch"}},
+		"steps":       []string{"bake"},
+		"yield":       8,
+	})
+	assertResponse(t, 422, "unknown unit pinch", resp)
+
+	resp = send(http.MethodPut, saves.URL+"/napoleon", admin, recipe(500, "mix", "bake"))
+	assertResponse(t, http.StatusCreated, "recipe of napoleon saved as v1", resp)
+
+	resp = send(http.MethodPut, saves.URL+"/napoleon", admin, recipe(600, "mix", "bake", "rest overnight"))
+	assertResponse(t, http.StatusCreated, "recipe of napoleon saved as v2", resp)
+
+	resp = send(http.MethodGet, recipes.URL+"?cake=millefeuille", user, nil)
+	assertResponse(t, http.StatusOK, "napoleon v2 by "+admin.Email+"\nserves 8\ningredients:\n"+
+		"- 600 g flour\n- 250 ml milk\n- 3 pcs eggs\n- 1 tsp vanilla\n"+
+		"steps:\n1. mix\n2. bake\n3. rest overnight", resp)
+
+	resp = send(http.MethodGet, recipes.URL+"?cake=napoleon&units=imperial", user, nil)
+	assertResponse(t, http.StatusOK, "napoleon v2 by "+admin.Email+"\nserves 8\ningredients:\n"+
+		"- 1.32 lb flour\n- 1.06 cup milk\n- 3 pcs eggs\n- 1 tsp vanilla\n"+
+		"steps:\n1. mix\n2. bake\n3. rest overnight", resp)
+
+	resp = send(http.MethodGet, recipes.URL+"?cake=napoleon&units=metric&servings=24", user, nil)
+	assertResponse(t, http.StatusOK, "napoleon v2 by "+admin.Email+"\nserves 24\ningredients:\n"+
+		"- 1.8 kg flour\n- 750 ml milk\n- 9 pcs eggs\n- 14.79 ml vanilla\n"+
+		"steps:\n1. mix\n2. bake\n3. rest overnight", resp)
+
+	resp = send(http.MethodGet, recipes.URL+"?cake=napoleon&units=imperial&servings=24", user, nil)
+	assertResponse(t, http.StatusOK, "napoleon v2 by "+admin.Email+"\nserves 24\ningredients:\n"+
+		"- 3.97 lb flour\n- 3.17 cup milk\n- 9 pcs eggs\n- 1 tbsp vanilla\n"+
+		"steps:\n1. mix\n2. bake\n3. rest overnight", resp)
+
+	resp = send(http.MethodGet, recipes.URL+"?cake=napoleon&version=1&servings=4&units=imperial", user, nil)
+	assertResponse(t, http.StatusOK, "napoleon v1 by "+admin.Email+"\nserves 4\ningredients:\n"+
+		"- 8.82 oz flour\n- 4.23 fl-oz milk\n- 1.5 pcs eggs\n- 0.5 tsp vanilla\n"+
+		"steps:\n1. mix\n2. bake", resp)
+
+	resp = send(http.MethodGet, recipes.URL+"?cake=napoleon&version=3", user, nil)
+	assertResponse(t, 422, "version must be from 1 to 2", resp)
+
+	resp = send(http.MethodGet, diffs.URL+"?cake=napoleon", user, nil)
+	assertResponse(t, http.StatusOK, "v1 -> v2:\n- - 500 g flour\n+ - 600 g flour\n+ 3. rest overnight", resp)
+
+	resp = send(http.MethodGet, diffs.URL+"?cake=napoleon&from=2&to=1", user, nil)
+	assertResponse(t, http.StatusOK, "v2 -> v1:\n- - 600 g flour\n+ - 500 g flour\n- 3. rest overnight", resp)
+
+	resp = send(http.MethodGet, histories.URL+"?cake=napoleon", user, nil)
+	assertResponse(t, http.StatusOK, "v1 2026-03-14T10:00:00Z by "+admin.Email+"\nv2 2026-03-14T10:00:00Z by "+admin.Email, resp)
+}
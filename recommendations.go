@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cakeHistorySize      = 20
+	recommendationsLimit = 5
+	recommendationsMax   = 20
+)
+
+// rememberCake moves the cake a user is leaving into their favorite history,
+// newest last, so the recommender still knows they liked it.
+func rememberCake(u *User, cakeID string) {
+	if cakeID == "" {
+		return
+	}
+
+	history := []string{}
+	if u.CakeHistory != nil {
+		for _, id := range *u.CakeHistory {
+			if id != cakeID {
+				history = append(history, id)
+			}
+		}
+	}
+	history = append(history, cakeID)
+	if len(history) > cakeHistorySize {
+		history = history[len(history)-cakeHistorySize:]
+	}
+
+	u.CakeHistory = &history
+}
+
+// likedCakes are the cakes a user has shown they like: favorites, past and
+// present, and the cakes they rated highly.
+func (s *UserService) likedCakes(u User) []string {
+	liked := favoriteCakes(u)
+	if u.CakeHistory != nil {
+		liked = append(liked, *u.CakeHistory...)
+	}
+	for _, review := range s.reviews.ListByAuthor(u.Email) {
+		if review.Rating >= likedRatingAtLeast && !review.Hidden() {
+			liked = append(liked, review.CakeID)
+		}
+	}
+	return liked
+}
+
+// Recommender scores cakes by how often they are liked by the same users as
+// the cakes one already likes. The co-occurrence model is rebuilt as a
+// whole and swapped in, so reads never see a half-built one.
+type Recommender struct {
+	lock  sync.RWMutex
+	model map[string]map[string]int
+}
+
+func NewRecommender() *Recommender {
+	return &Recommender{
+		model: make(map[string]map[string]int),
+	}
+}
+
+func (r *Recommender) Rebuild(likes [][]string) {
+	model := make(map[string]map[string]int)
+	for _, liked := range likes {
+		set := map[string]bool{}
+		for _, id := range liked {
+			set[id] = true
+		}
+		for a := range set {
+			for b := range set {
+				if a == b {
+					continue
+				}
+				if model[a] == nil {
+					model[a] = make(map[string]int)
+				}
+				model[a][b]++
+			}
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.model = model
+}
+
+// Recommend returns up to n cakes not in liked, the most co-liked first.
+func (r *Recommender) Recommend(liked []string, n int) []CakeCount {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	exclude := map[string]bool{}
+	for _, id := range liked {
+		exclude[id] = true
+	}
+
+	scores := map[string]int{}
+	for id := range exclude {
+		for other, count := range r.model[id] {
+			if !exclude[other] {
+				scores[other] += count
+			}
+		}
+	}
+	return rankCakes(scores, n)
+}
+
+func (s *UserService) rebuildRecommendations() {
+	likes := [][]string{}
+	for _, user := range s.repository.List() {
+		likes = append(likes, s.likedCakes(user))
+	}
+	s.recommender.Rebuild(likes)
+}
+
+func (s *UserService) runRecommendations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		start := time.Now()
+		s.rebuildRecommendations()
+		log.Printf("Rebuilt cake recommendations in %s", time.Since(start))
+	}
+}
+
+func (s *UserService) recommendationsHandler(w http.ResponseWriter, r *http.Request, u User) {
+	limit, err := queryInt(r, "limit", recommendationsLimit, recommendationsMax)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	liked := s.likedCakes(u)
+	header := "recommended for you:"
+	cakes := s.recommender.Recommend(liked, limit)
+	if len(cakes) == 0 {
+		// Nobody shares this user's taste yet, so fall back to what is
+		// popular overall.
+		header = "popular cakes:"
+		exclude := map[string]bool{}
+		for _, id := range liked {
+			exclude[id] = true
+		}
+		for _, count := range s.stats.Top(0) {
+			if !exclude[count.CakeID] && len(cakes) < limit {
+				cakes = append(cakes, count)
+			}
+		}
+	}
+
+	if len(cakes) == 0 {
+		writeResponse(w, http.StatusOK, "there are no recommendations yet")
+		return
+	}
+
+	lines := []string{header}
+	for _, cake := range cakes {
+		lines = append(lines, s.cakeName(cake.CakeID))
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
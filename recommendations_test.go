@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCakeRecommendations(t *testing.T) {
+	doRequest := createRequester(t)
+
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	recs := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.recommendationsHandler))))
+	upds := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.UpdateFavoriteCakeHandler)))
+	defer func() {
+		recs.Close()
+		upds.Close()
+	}()
+
+	addUser := func(cake string, history ...string) User {
+		user := newUser()
+		user.FavoriteCakeID = cake
+		if len(history) > 0 {
+			user.CakeHistory = &history
+		}
+		u.repository.Add(user.Email, user)
+		return user
+	}
+
+	addUser("cheesecake", "napoleon")
+	addUser("cheesecake", "tiramisu", "napoleon")
+	addUser("brownie")
+	newcomer := addUser("pavlova")
+	fan := addUser("cheesecake")
+
+	u.stats = NewCakeStats(u.repository.List())
+	u.rebuildRecommendations()
+
+	recommend := func(user User, query string) parsedResponse {
+		jwt, _ := j.GenearateJWT(user)
+		req, err := http.NewRequest(http.MethodGet, recs.URL+query, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+jwt,
+		)
+		return doRequest(req, err)
+	}
+
+	resp := recommend(fan, "")
+	assertResponse(t, http.StatusOK, "recommended for you:\nnapoleon\ntiramisu", resp)
+
+	resp = recommend(fan, "?limit=1")
+	assertResponse(t, http.StatusOK, "recommended for you:\nnapoleon", resp)
+
+	resp = recommend(newcomer, "")
+	assertResponse(t, http.StatusOK, "popular cakes:\ncheesecake\nbrownie", resp)
+
+	jwt, _ := j.GenearateJWT(fan)
+	req, err := http.NewRequest(http.MethodPost, upds.URL, prepareParams(t, Params{
+		"favorite_cake": "brownie",
+	}))
+	req.Header.Add(
+		"Authorization",
+		"Bearer "+jwt,
+	)
+	assertStatus(t, http.StatusOK, doRequest(req, err))
+
+	fan, _ = u.repository.Get(fan.Email)
+	if fan.CakeHistory == nil || len(*fan.CakeHistory) != 1 || (*fan.CakeHistory)[0] != "cheesecake" {
+		t.Errorf("Expected cheesecake in history but got %v", fan.CakeHistory)
+	}
+
+	u.rebuildRecommendations()
+	resp = recommend(fan, "")
+	assertResponse(t, http.StatusOK, "recommended for you:\nnapoleon\ntiramisu", resp)
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUsers_Register(t *testing.T) {
@@ -39,7 +41,7 @@ func TestUsers_Register(t *testing.T) {
 
 		resp := getResp(regParams)
 		assertStatus(t, 422, resp)
-		assertBody(t, "Unvalid email address", resp)
+		assertBody(t, "invalid email address", resp)
 	})
 
 	t.Run("user already exists", func(t *testing.T) {
@@ -69,7 +71,40 @@ func TestUsers_Register(t *testing.T) {
 
 		resp := getResp(regParams)
 		assertStatus(t, 422, resp)
-		assertBody(t, "Password too short", resp)
+		assertBody(t, "password too short", resp)
+	})
+
+	t.Run("password length is counted in symbols", func(t *testing.T) {
+		regParams := Params{
+			"email":         "test@mail.com",
+			"password":      "тортик",
+			"favorite_cake": "cheesecake",
+		}
+
+		resp := getResp(regParams)
+		assertResponse(t, 422, "password too short", resp)
+	})
+
+	t.Run("common password", func(t *testing.T) {
+		regParams := Params{
+			"email":         "test@mail.com",
+			"password":      "Password123",
+			"favorite_cake": "cheesecake",
+		}
+
+		resp := getResp(regParams)
+		assertResponse(t, 422, "password is too common", resp)
+	})
+
+	t.Run("password contains email", func(t *testing.T) {
+		regParams := Params{
+			"email":         "bob@mail.com",
+			"password":      "mynameisbob",
+			"favorite_cake": "cheesecake",
+		}
+
+		resp := getResp(regParams)
+		assertResponse(t, 422, "password must not contain email", resp)
 	})
 
 	t.Run("favorit cake can not be empty", func(t *testing.T) {
@@ -80,18 +115,136 @@ func TestUsers_Register(t *testing.T) {
 
 		resp := getResp(regParams)
 		assertStatus(t, 422, resp)
-		assertBody(t, "Favorit cake can't be empty", resp)
+		assertBody(t, "favorite cake can't be empty", resp)
 	})
 
 	t.Run("favorit cake can contain only letters", func(t *testing.T) {
 		regParams := Params{
 			"email":         "test@mail.com",
 			"password":      "somepass",
-			"favorite_cake": "cheese cake",
+			"favorite_cake": "cheesecake #1",
 		}
 
 		resp := getResp(regParams)
 		assertStatus(t, 422, resp)
-		assertBody(t, "Favorit cake can contain only letters", resp)
+		assertBody(t, "favorite cake can contain only letters, spaces and hyphens", resp)
+	})
+
+	t.Run("favorite cake names are unicode", func(t *testing.T) {
+		for _, cake := range []string{"crème brûlée", "Crème  Brûlée", "cre\u0300me bru\u0302le\u0301e", "tiramisù", "Шарлотка", "Black Forest"} {
+			resp := getResp(Params{
+				"email":         "test@mail.com",
+				"password":      "somepass",
+				"favorite_cake": cake,
+			})
+			assertResponse(t, http.StatusCreated, "registered", resp)
+		}
+	})
+
+	t.Run("favorite cake length is counted in symbols", func(t *testing.T) {
+		resp := getResp(Params{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": strings.Repeat("ш", cakeNameMaxLength+1),
+		})
+		assertResponse(t, 422, "favorite cake too long", resp)
+	})
+
+	t.Run("favorite cake of the longest name in symbols", func(t *testing.T) {
+		u := newTestUserService()
+		name := strings.Repeat("ш", cakeNameMaxLength)
+		u.cakes.Add(Cake{ID: cakeID(name), Name: name})
+
+		regs := httptest.NewServer(http.HandlerFunc(u.Register))
+		defer regs.Close()
+
+		resp := doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": strings.ToUpper(name),
+		})))
+		assertResponse(t, 201, "registered", resp)
+	})
+}
+
+func TestUsers_Verification(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("login requires verified email", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		regs := httptest.NewServer(http.HandlerFunc(u.Register))
+		vers := httptest.NewServer(http.HandlerFunc(u.VerifyEmailHandler))
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer func() {
+			regs.Close()
+			vers.Close()
+			jwts.Close()
+		}()
+
+		doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "cheesecake",
+		})))
+
+		jwtParams := Params{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, jwtParams)))
+		assertResponse(t, 401, "email test@mail.com is not verified", resp)
+
+		token := mailedToken(t, u, "test@mail.com")
+
+		resp = doRequest(http.NewRequest(http.MethodGet, vers.URL+"?token="+token[:len(token)-2]+"xx", nil))
+		assertResponse(t, 422, "invalid or expired token", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodGet, vers.URL+"?token="+token, nil))
+		assertResponse(t, http.StatusOK, "email verified", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, vers.URL, prepareParams(t, Params{"token": token}))) // single use
+		assertResponse(t, 422, "invalid or expired token", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, jwtParams)))
+		assertStatus(t, http.StatusOK, resp)
+	})
+
+	t.Run("resend verification", func(t *testing.T) {
+		u := newTestUserService()
+
+		regs := httptest.NewServer(http.HandlerFunc(u.Register))
+		resends := httptest.NewServer(http.HandlerFunc(u.ResendVerificationHandler))
+		defer func() {
+			regs.Close()
+			resends.Close()
+		}()
+
+		doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "cheesecake",
+		})))
+		first := mailedToken(t, u, "test@mail.com")
+
+		resp := doRequest(http.NewRequest(http.MethodPost, resends.URL, prepareParams(t, Params{"email": "test@mail.com"})))
+		assertResponse(t, http.StatusTooManyRequests, "verification email was sent recently, try again later", resp)
+
+		user, _ := u.repository.Get("test@mail.com")
+		user.VerificationSentAt = time.Now().Add(-time.Hour).UnixNano()
+		u.repository.Update(user.Email, user)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, resends.URL, prepareParams(t, Params{"email": "test@mail.com"})))
+		assertResponse(t, http.StatusOK, "if the email awaits verification, a new link has been sent", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, resends.URL, prepareParams(t, Params{"email": "nobody@mail.com"})))
+		assertResponse(t, http.StatusOK, "if the email awaits verification, a new link has been sent", resp)
+
+		if _, err := u.verifyEmail(first); err == nil {
+			t.Errorf("Expected previous verification link to be invalidated")
+		}
+		verifyEmail(t, u, "test@mail.com")
 	})
 }
@@ -16,7 +16,7 @@ func TestUsers_Repository(t *testing.T) {
 		user := User{
 			Email:          "test@mail.com",
 			PasswordDigest: "passtest",
-			FavoriteCake:   "cheesecake",
+			FavoriteCakeID: "cheesecake",
 		}
 
 		users.Add(user.Email, user)
@@ -37,7 +37,7 @@ func TestUsers_Repository(t *testing.T) {
 		user := User{
 			Email:          "test@mail.com",
 			PasswordDigest: "passtest",
-			FavoriteCake:   "cheesecake",
+			FavoriteCakeID: "cheesecake",
 		}
 
 		users.Add(user.Email, user)
@@ -62,13 +62,13 @@ func TestUsers_Repository(t *testing.T) {
 		oldUser := User{
 			Email:          "test@mail.com",
 			PasswordDigest: "passtest",
-			FavoriteCake:   "cheesecake",
+			FavoriteCakeID: "cheesecake",
 		}
 
 		newUser := User{
 			Email:          "test@mail.com",
 			PasswordDigest: "testpass",
-			FavoriteCake:   "napoleon",
+			FavoriteCakeID: "napoleon",
 		}
 
 		users.Add(oldUser.Email, oldUser)
@@ -93,7 +93,7 @@ func TestUsers_Repository(t *testing.T) {
 		user := User{
 			Email:          "test@mail.com",
 			PasswordDigest: "passtest",
-			FavoriteCake:   "cheesecake",
+			FavoriteCakeID: "cheesecake",
 		}
 
 		users.Add(user.Email, user)
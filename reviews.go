@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	reviewMaxLength    = 2000
+	reviewsPerPage     = 10
+	reviewsMaxPerPage  = 50
+	likedRatingAtLeast = 4
+)
+
+type ReviewRevision struct {
+	Rating int
+	Text   string
+	At     int64
+}
+
+// Review is the single review an author keeps per cake. Edits push the
+// previous revision into History, oldest first.
+type Review struct {
+	CakeID    string
+	Author    string
+	Rating    int
+	Text      string
+	CreatedAt int64
+	UpdatedAt int64
+	History   []ReviewRevision
+
+	HiddenBy     string
+	HiddenReason string
+}
+
+func (r Review) Hidden() bool {
+	return r.HiddenBy != ""
+}
+
+type ReviewRepository interface {
+	Put(Review) error
+	// Write creates the review of author or edits it, keeping the previous
+	// version in its history, as one step. It tells whether it created it.
+	Write(cakeID, author string, rating int, text string, at int64) (bool, error)
+	Get(cakeID, author string) (Review, error)
+	List(cakeID string) []Review
+	ListByAuthor(author string) []Review
+	Delete(cakeID, author string) error
+}
+
+type InMemoryReviewStorage struct {
+	lock    sync.RWMutex
+	reviews map[string]map[string]Review
+}
+
+func NewInMemoryReviewStorage() *InMemoryReviewStorage {
+	return &InMemoryReviewStorage{
+		reviews: make(map[string]map[string]Review),
+	}
+}
+
+func (s *InMemoryReviewStorage) Put(review Review) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.reviews[review.CakeID] == nil {
+		s.reviews[review.CakeID] = make(map[string]Review)
+	}
+	s.reviews[review.CakeID][review.Author] = review
+	return nil
+}
+
+func (s *InMemoryReviewStorage) Write(cakeID, author string, rating int, text string, at int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.reviews[cakeID] == nil {
+		s.reviews[cakeID] = make(map[string]Review)
+	}
+	review, ok := s.reviews[cakeID][author]
+	if !ok {
+		review = Review{CakeID: cakeID, Author: author, CreatedAt: at}
+	} else {
+		// Copied, so the reviews handed out before never see the new revision.
+		history := make([]ReviewRevision, len(review.History), len(review.History)+1)
+		copy(history, review.History)
+		review.History = append(history, ReviewRevision{
+			Rating: review.Rating,
+			Text:   review.Text,
+			At:     review.UpdatedAt,
+		})
+	}
+	review.Rating = rating
+	review.Text = text
+	review.UpdatedAt = at
+	s.reviews[cakeID][author] = review
+	return !ok, nil
+}
+
+func (s *InMemoryReviewStorage) Get(cakeID, author string) (Review, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	review, ok := s.reviews[cakeID][author]
+	if !ok {
+		return Review{}, errors.New("review not found")
+	}
+	return review, nil
+}
+
+func sortReviews(reviews []Review) {
+	sort.Slice(reviews, func(i, j int) bool {
+		if reviews[i].UpdatedAt != reviews[j].UpdatedAt {
+			return reviews[i].UpdatedAt > reviews[j].UpdatedAt
+		}
+		return reviews[i].Author < reviews[j].Author
+	})
+}
+
+// List returns the reviews of a cake, the most recently updated first.
+func (s *InMemoryReviewStorage) List(cakeID string) []Review {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	reviews := []Review{}
+	for _, review := range s.reviews[cakeID] {
+		reviews = append(reviews, review)
+	}
+	sortReviews(reviews)
+	return reviews
+}
+
+func (s *InMemoryReviewStorage) ListByAuthor(author string) []Review {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	reviews := []Review{}
+	for _, byAuthor := range s.reviews {
+		if review, ok := byAuthor[author]; ok {
+			reviews = append(reviews, review)
+		}
+	}
+	sortReviews(reviews)
+	return reviews
+}
+
+func (s *InMemoryReviewStorage) Delete(cakeID, author string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.reviews[cakeID][author]; !ok {
+		return errors.New("review not found")
+	}
+	delete(s.reviews[cakeID], author)
+	return nil
+}
+
+// moveReviews keeps the reviews of a renamed account attributed to it.
+func (s *UserService) moveReviews(from, to string) error {
+	for _, review := range s.reviews.ListByAuthor(from) {
+		if err := s.reviews.Delete(review.CakeID, from); err != nil {
+			return err
+		}
+		review.Author = to
+		if err := s.reviews.Put(review); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reviewedCakeID accepts any valid cake name. Names of the catalog are
+// reviewed under their cake, so aliases share one set of reviews.
+func (s *UserService) reviewedCakeID(name string) (string, error) {
+	name, err := normalizeCake(name)
+	if err != nil {
+		return "", err
+	}
+	if cake, err := s.cakes.Find(name); err == nil {
+		return cake.ID, nil
+	}
+	return cakeID(name), nil
+}
+
+// visibleReviews drops hidden reviews and those of banned authors.
+func (s *UserService) visibleReviews(cakeID string) []Review {
+	reviews := []Review{}
+	for _, review := range s.reviews.List(cakeID) {
+		if review.Hidden() {
+			continue
+		}
+		if author, err := s.repository.Get(review.Author); err == nil && UserHasBan(author) {
+			continue
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews
+}
+
+type ReviewParams struct {
+	Cake   string `json:"cake"`
+	Rating int    `json:"rating"`
+	Review string `json:"review"`
+}
+
+func (s *UserService) reviewCakeHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &ReviewParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	cakeID, err := s.reviewedCakeID(params.Cake)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if params.Rating < 1 || params.Rating > 5 {
+		handleError(errors.New("rating must be from 1 to 5"), w)
+		return
+	}
+
+	params.Review = strings.TrimSpace(params.Review)
+	if utf8.RuneCountInString(params.Review) > reviewMaxLength {
+		handleError(errors.New("review too long"), w)
+		return
+	}
+
+	created, err := s.reviews.Write(cakeID, u.Email, params.Rating, params.Review, time.Now().UnixNano())
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if created {
+		writeResponse(w, http.StatusCreated, "review of "+s.cakeName(cakeID)+" created")
+	} else {
+		writeResponse(w, http.StatusOK, "review of "+s.cakeName(cakeID)+" updated")
+	}
+	s.notifier <- []byte("reviewed: " + cakeID + " by " + u.Email)
+}
+
+func formatReview(review Review) string {
+	line := review.Author + " " + strconv.Itoa(review.Rating) + "/5"
+	if len(review.History) > 0 {
+		line += " (edited)"
+	}
+	if review.Text != "" {
+		line += ": " + review.Text
+	}
+	return line
+}
+
+func (s *UserService) listReviewsHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cakeID, err := s.reviewedCakeID(r.URL.Query().Get("cake"))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	perPage, err := queryInt(r, "per_page", reviewsPerPage, reviewsMaxPerPage)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	reviews := s.visibleReviews(cakeID)
+	if len(reviews) == 0 {
+		writeResponse(w, http.StatusOK, s.cakeName(cakeID)+" does not have any reviews")
+		return
+	}
+
+	pages := (len(reviews) + perPage - 1) / perPage
+	page, err := queryInt(r, "page", 1, pages)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	total := 0
+	for _, review := range reviews {
+		total += review.Rating
+	}
+	average := float64(total) / float64(len(reviews))
+
+	lines := []string{
+		s.cakeName(cakeID) + ": " + strconv.FormatFloat(average, 'f', 1, 64) + " from " + strconv.Itoa(len(reviews)) + " ratings",
+		"page " + strconv.Itoa(page) + " of " + strconv.Itoa(pages),
+	}
+	for i := (page - 1) * perPage; i < len(reviews) && i < page*perPage; i++ {
+		lines = append(lines, formatReview(reviews[i]))
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+// reviewHistoryHandler shows the revisions of a review to its author, and
+// to those who moderate reviews.
+func (s *UserService) reviewHistoryHandler(w http.ResponseWriter, r *http.Request, u User) {
+	cakeID, err := s.reviewedCakeID(r.URL.Query().Get("cake"))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	author := u.Email
+	if email := r.URL.Query().Get("email"); email != "" {
+		author, err = s.normalizeEmail(email)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+	}
+	if author != u.Email && !s.policy.Can(u.Role, permUsersBan) {
+		writeResponse(w, 401, "not enough rights to performe this action")
+		return
+	}
+
+	review, err := s.reviews.Get(cakeID, author)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	revisions := append([]ReviewRevision{}, review.History...)
+	revisions = append(revisions, ReviewRevision{Rating: review.Rating, Text: review.Text, At: review.UpdatedAt})
+
+	lines := []string{}
+	for _, revision := range revisions {
+		lines = append(lines, time.Unix(0, revision.At).UTC().Format(time.RFC3339)+" "+
+			strconv.Itoa(revision.Rating)+"/5: "+revision.Text)
+	}
+	if review.Hidden() {
+		lines = append(lines, "hidden by "+review.HiddenBy+" because '"+review.HiddenReason+"'")
+	}
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
+
+type ReviewModerationParams struct {
+	Cake   string `json:"cake"`
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+	Ban    bool   `json:"ban"`
+}
+
+// moderateReview finds the review a moderation request is about, checking
+// that the moderator manages its author, and bans the author if asked.
+func (s *UserService) moderateReview(w http.ResponseWriter, r *http.Request, u User) (Review, bool) {
+	params := &ReviewModerationParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return Review{}, false
+	}
+
+	cakeID, err := s.reviewedCakeID(params.Cake)
+	if err != nil {
+		handleError(err, w)
+		return Review{}, false
+	}
+
+	email, err := s.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return Review{}, false
+	}
+
+	review, err := s.reviews.Get(cakeID, email)
+	if err != nil {
+		handleError(err, w)
+		return Review{}, false
+	}
+
+	author, err := s.repository.Get(review.Author)
+	if err != nil {
+		handleError(err, w)
+		return Review{}, false
+	}
+
+	if !s.validateAdminAction(w, u, author) {
+		return Review{}, false
+	}
+
+	if params.Ban && !UserHasBan(author) {
+		if err := s.BanUser(author.Email, u.Email, params.Reason); err != nil {
+			handleError(err, w)
+			return Review{}, false
+		}
+	}
+
+	review.HiddenBy = u.Email
+	review.HiddenReason = params.Reason
+	return review, true
+}
+
+func (s *UserService) hideReviewHandler(w http.ResponseWriter, r *http.Request, u User) {
+	review, ok := s.moderateReview(w, r, u)
+	if !ok {
+		return
+	}
+
+	if err := s.reviews.Put(review); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "review of "+s.cakeName(review.CakeID)+" by "+review.Author+" is hidden now")
+	s.notifier <- []byte("review hidden: " + review.CakeID + " by " + review.Author + " by " + u.Email)
+}
+
+func (s *UserService) removeReviewHandler(w http.ResponseWriter, r *http.Request, u User) {
+	review, ok := s.moderateReview(w, r, u)
+	if !ok {
+		return
+	}
+
+	if err := s.reviews.Delete(review.CakeID, review.Author); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "review of "+s.cakeName(review.CakeID)+" by "+review.Author+" is removed")
+	s.notifier <- []byte("review removed: " + review.CakeID + " by " + review.Author + " by " + u.Email)
+}
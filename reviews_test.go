@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCakeReviews(t *testing.T) {
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	reviews := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileWrite, u.reviewCakeHandler))))
+	lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.listReviewsHandler))))
+	histories := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.reviewHistoryHandler))))
+	hides := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersBan, u.hideReviewHandler))))
+	removes := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersBan, u.removeReviewHandler))))
+	defer func() {
+		reviews.Close()
+		lists.Close()
+		histories.Close()
+		hides.Close()
+		removes.Close()
+	}()
+
+	alice := newUser()
+	u.repository.Add(alice.Email, alice)
+	bob := newUser()
+	u.repository.Add(bob.Email, bob)
+	carol := newUser()
+	u.repository.Add(carol.Email, carol)
+	admin := newAdmin()
+	u.repository.Add(admin.Email, admin)
+
+	send := createSender(t, j)
+
+	review := func(user User, cake string, rating int, text string) parsedResponse {
+		resp := send(http.MethodPost, reviews.URL, user, Params{"cake": cake, "rating": rating, "review": text})
+		if resp.status < 300 {
+			<-u.notifier
+		}
+		return resp
+	}
+
+	resp := review(alice, "napoleon", 6, "")
+	assertResponse(t, 422, "rating must be from 1 to 5", resp)
+
+	resp = review(alice, "napoleon!", 5, "")
+	assertResponse(t, 422, "favorite cake can contain only letters, spaces and hyphens", resp)
+
+	resp = review(alice, "Millefeuille", 3, "fine")
+	assertResponse(t, http.StatusCreated, "review of napoleon created", resp)
+
+	resp = review(alice, "napoleon", 5, "grew on me")
+	assertResponse(t, http.StatusOK, "review of napoleon updated", resp)
+
+	review(bob, "napoleon", 4, "")
+	review(carol, "napoleon", 1, "spam spam spam")
+
+	resp = review(bob, "Kyiv cake", 5, "not in the catalog yet")
+	assertResponse(t, http.StatusCreated, "review of kyiv-cake created", resp)
+
+	resp = send(http.MethodGet, lists.URL+"?cake=napoleon&per_page=2&page=2", alice, nil)
+	assertResponse(t, http.StatusOK, "napoleon: 3.3 from 3 ratings\npage 2 of 2\n"+alice.Email+" 5/5 (edited): grew on me", resp)
+
+	resp = send(http.MethodGet, lists.URL+"?cake=napoleon&page=3", alice, nil)
+	assertResponse(t, 422, "page must be a number from 1 to 1", resp)
+
+	resp = send(http.MethodGet, histories.URL+"?cake=napoleon", alice, nil)
+	assertStatus(t, http.StatusOK, resp)
+	lines := strings.Split(string(resp.body), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " 3/5: fine") || !strings.HasSuffix(lines[1], " 5/5: grew on me") {
+		t.Errorf("Unexpected history %s", resp.body)
+	}
+
+	resp = send(http.MethodGet, histories.URL+"?cake=napoleon&email="+alice.Email, bob, nil)
+	assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+	resp = send(http.MethodPost, hides.URL, bob, Params{"cake": "napoleon", "email": carol.Email})
+	assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+	resp = send(http.MethodPost, hides.URL, admin, Params{"cake": "napoleon", "email": carol.Email, "reason": "spam", "ban": true})
+	assertResponse(t, http.StatusOK, "review of napoleon by "+carol.Email+" is hidden now", resp)
+	expectEvent(t, u, "review hidden: napoleon by "+carol.Email+" by "+admin.Email)
+
+	if carol, _ = u.repository.Get(carol.Email); !UserHasBan(carol) {
+		t.Errorf("Expected author to be banned")
+	}
+
+	resp = send(http.MethodGet, lists.URL+"?cake=napoleon", alice, nil)
+	assertStatus(t, http.StatusOK, resp)
+	if !strings.HasPrefix(string(resp.body), "napoleon: 4.5 from 2 ratings\npage 1 of 1\n") {
+		t.Errorf("Unexpected reviews %s", resp.body)
+	}
+
+	resp = send(http.MethodPost, removes.URL, admin, Params{"cake": "kyiv cake", "email": bob.Email})
+	assertResponse(t, http.StatusOK, "review of kyiv-cake by "+bob.Email+" is removed", resp)
+	<-u.notifier
+
+	resp = send(http.MethodGet, lists.URL+"?cake=kyiv%20cake", alice, nil)
+	assertResponse(t, http.StatusOK, "kyiv-cake does not have any reviews", resp)
+
+	if liked := u.likedCakes(bob); len(liked) != 2 || liked[1] != "napoleon" {
+		t.Errorf("Expected highly rated cake to be liked but got %v", liked)
+	}
+}
+
+func TestReviewEditsAreAtomic(t *testing.T) {
+	reviews := NewInMemoryReviewStorage()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(rating int) {
+			defer wg.Done()
+			reviews.Write("napoleon", "critic@mail.com", rating, "", time.Now().UnixNano())
+		}(i%5 + 1)
+	}
+	wg.Wait()
+
+	review, err := reviews.Get("napoleon", "critic@mail.com")
+	if err != nil || len(review.History) != 19 {
+		t.Errorf("Expected every edit to be kept but got %d revisions, %v", len(review.History), err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const userAgentMaxLength = 256
+
+type Session struct {
+	ID         string
+	Email      string
+	CreatedAt  int64
+	LastSeenAt int64
+	IP         string
+	UserAgent  string
+
+	ImpersonatedBy string
+	ExpiresAt      int64
+}
+
+func (s Session) Expired(now time.Time) bool {
+	return s.ExpiresAt != 0 && now.UnixNano() >= s.ExpiresAt
+}
+
+type SessionRepository interface {
+	Add(Session) error
+	Get(id string) (Session, error)
+	List(email string) []Session
+	Touch(id string, at int64) error
+	Delete(id string) error
+	DeleteExpired(now time.Time) int
+}
+
+type InMemorySessionStorage struct {
+	lock     sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewInMemorySessionStorage() *InMemorySessionStorage {
+	return &InMemorySessionStorage{
+		sessions: make(map[string]Session),
+	}
+}
+
+func (s *InMemorySessionStorage) Add(session Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.sessions[session.ID]; ok {
+		return errors.New("session with such id already exists")
+	}
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *InMemorySessionStorage) Get(id string) (Session, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, errors.New("session not found")
+	}
+	return session, nil
+}
+
+func (s *InMemorySessionStorage) List(email string) []Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		if session.Email == email {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt < sessions[j].CreatedAt })
+	return sessions
+}
+
+func (s *InMemorySessionStorage) Touch(id string, at int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return errors.New("session not found")
+	}
+	session.LastSeenAt = at
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *InMemorySessionStorage) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.sessions[id]; !ok {
+		return errors.New("session not found")
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+// DeleteExpired deletes the sessions whose tokens can no longer be used and
+// returns how many there were.
+func (s *InMemorySessionStorage) DeleteExpired(now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	deleted := 0
+	for id, session := range s.sessions {
+		if session.Expired(now) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+type sessionContextKey struct{}
+
+func withSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+func sessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(Session)
+	return session, ok
+}
+
+func userAgent(r *http.Request) string {
+	agent := r.UserAgent()
+	if len(agent) > userAgentMaxLength {
+		agent = agent[:userAgentMaxLength]
+	}
+	return agent
+}
+
+func newSession(r *http.Request, email string) (Session, error) {
+	id, err := randomToken(18)
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	return Session{
+		ID:         id,
+		Email:      email,
+		CreatedAt:  now.UnixNano(),
+		LastSeenAt: now.UnixNano(),
+		IP:         clientIP(r),
+		UserAgent:  userAgent(r),
+		ExpiresAt:  now.Add(jwtLifetime).UnixNano(),
+	}, nil
+}
+
+func (s *UserService) startSession(r *http.Request, email string) (Session, error) {
+	session, err := newSession(r, email)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, s.sessions.Add(session)
+}
+
+// endSessions deletes every session of email, for when its tokens stop being
+// valid anyway.
+func (s *UserService) endSessions(email string) {
+	for _, session := range s.sessions.List(email) {
+		s.sessions.Delete(session.ID)
+	}
+}
+
+func (s *UserService) runSessionsSweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if deleted := s.sessions.DeleteExpired(time.Now()); deleted > 0 {
+			log.Printf("Deleted %d expired sessions", deleted)
+		}
+	}
+}
+
+func formatSessions(sessions []Session, current string) string {
+	lines := make([]string, len(sessions))
+	for i, session := range sessions {
+		line := session.ID +
+			" created " + time.Unix(0, session.CreatedAt).UTC().Format(time.RFC3339) +
+			" last seen " + time.Unix(0, session.LastSeenAt).UTC().Format(time.RFC3339) +
+			" from " + session.IP +
+			" '" + session.UserAgent + "'"
+		if session.ImpersonatedBy != "" {
+			line += " impersonated by " + session.ImpersonatedBy
+		}
+		if session.ID == current {
+			line += " (current)"
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *UserService) ListSessionsHandler(w http.ResponseWriter, r *http.Request, u User) {
+	sessions := s.sessions.List(u.Email)
+	if len(sessions) == 0 {
+		writeResponse(w, http.StatusOK, "user "+u.Email+" does not have any sessions")
+		return
+	}
+
+	current, _ := sessionFromContext(r.Context())
+	writeResponse(w, http.StatusOK, formatSessions(sessions, current.ID))
+}
+
+func (s *UserService) DeleteSessionHandler(w http.ResponseWriter, r *http.Request, u User) {
+	session, err := s.sessions.Get(mux.Vars(r)["id"])
+	if err != nil || session.Email != u.Email {
+		handleError(errors.New("session not found"), w)
+		return
+	}
+
+	if err := s.sessions.Delete(session.ID); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "session "+session.ID+" deleted")
+	s.notifier <- []byte("session deleted: " + u.Email)
+}
+
+func (s *UserService) adminListSessionsHandler(w http.ResponseWriter, r *http.Request, u User) {
+	email, err := s.normalizeEmail(r.URL.Query().Get("email"))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	target, err := s.repository.Get(email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if !s.validateAdminAction(w, u, target) {
+		return
+	}
+
+	sessions := s.sessions.List(target.Email)
+	if len(sessions) == 0 {
+		writeResponse(w, http.StatusOK, "user "+target.Email+" does not have any sessions")
+		return
+	}
+
+	writeResponse(w, http.StatusOK, formatSessions(sessions, ""))
+}
+
+func (s *UserService) adminDeleteSessionHandler(w http.ResponseWriter, r *http.Request, u User) {
+	session, err := s.sessions.Get(mux.Vars(r)["id"])
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	target, err := s.repository.Get(session.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if !s.validateAdminAction(w, u, target) {
+		return
+	}
+
+	if err := s.sessions.Delete(session.ID); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "session "+session.ID+" deleted")
+	s.notifier <- []byte("session deleted: " + target.Email + " by " + u.Email)
+}
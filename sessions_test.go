@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func withPathID(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, mux.SetURLVars(r, map[string]string{"id": strings.TrimPrefix(r.URL.Path, "/")}))
+	}
+}
+
+func TestUsers_Sessions(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("list and delete own sessions", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.sessions = u.sessions
+
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.ListSessionsHandler))))
+		deletes := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permAccount, u.DeleteSessionHandler))))
+		defer func() {
+			jwts.Close()
+			lists.Close()
+			deletes.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		login := func(agent string) string {
+			req, err := http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+				"email":    user.Email,
+				"password": DefaultPassword,
+			}))
+			req.Header.Set("User-Agent", agent)
+			resp := doRequest(req, err)
+			assertSessionJWT(t, j, u, user.Email, resp)
+			return string(resp.body)
+		}
+
+		laptopJwt := login("laptop")
+		phoneJwt := login("phone")
+
+		if msg := string(<-u.notifier); msg != "@"+user.Email+" new device: 127.0.0.1 'phone'" {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		forgedJwt, _ := j.GenearateJWT(user) // tokens must belong to a session
+		req, err := http.NewRequest(http.MethodGet, lists.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+forgedJwt,
+		)
+		resp := doRequest(req, err)
+		assertResponse(t, 401, "unauthorized", resp)
+
+		req, err = http.NewRequest(http.MethodGet, lists.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+laptopJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+
+		lines := strings.Split(string(resp.body), "\n")
+		if len(lines) != 2 ||
+			!strings.HasSuffix(lines[0], " from 127.0.0.1 'laptop' (current)") ||
+			!strings.HasSuffix(lines[1], " from 127.0.0.1 'phone'") {
+			t.Fatalf("Unexpected sessions %s", resp.body)
+		}
+		phone := strings.Fields(lines[1])[0]
+
+		req, err = http.NewRequest(http.MethodDelete, deletes.URL+"/"+phone, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+laptopJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "session "+phone+" deleted", resp)
+
+		if msg := string(<-u.notifier); msg != "session deleted: "+user.Email {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, lists.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+phoneJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 401, "unauthorized", resp)
+
+		req, err = http.NewRequest(http.MethodDelete, deletes.URL+"/"+phone, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+laptopJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 422, "session not found", resp)
+	})
+
+	t.Run("admin manages sessions of users", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.sessions = u.sessions
+
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		cks := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.getCakeHandler))))
+		lists := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersSessions, u.adminListSessionsHandler))))
+		deletes := httptest.NewServer(withPathID(j.JWTAuth(u.repository, u.policy.Require(permUsersSessions, u.adminDeleteSessionHandler))))
+		defer func() {
+			jwts.Close()
+			cks.Close()
+			lists.Close()
+			deletes.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		otherAdmin := newAdmin()
+		u.repository.Add(otherAdmin.Email, otherAdmin)
+
+		admin := newAdmin()
+		adminSession, _ := u.startSession(httptest.NewRequest(http.MethodPost, "/", nil), admin.Email)
+		adminJwt, _ := j.GenerateSessionJWT(admin, adminSession)
+		u.repository.Add(admin.Email, admin)
+
+		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+			"email":    user.Email,
+			"password": DefaultPassword,
+		})))
+		assertSessionJWT(t, j, u, user.Email, resp)
+		userJwt := string(resp.body)
+
+		req, err := http.NewRequest(http.MethodGet, lists.URL+"?email="+otherAdmin.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 401, "not enough rights to performe this action", resp)
+
+		req, err = http.NewRequest(http.MethodGet, lists.URL+"?email="+user.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+
+		session := strings.Fields(string(resp.body))[0]
+
+		req, err = http.NewRequest(http.MethodDelete, deletes.URL+"/"+session, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "session "+session+" deleted", resp)
+
+		if msg := string(<-u.notifier); msg != "session deleted: "+user.Email+" by "+admin.Email {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, cks.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 401, "unauthorized", resp)
+	})
+
+	t.Run("expired sessions are swept", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.sessions = u.sessions
+
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer jwts.Close()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+			"email":    user.Email,
+			"password": DefaultPassword,
+		})))
+		assertSessionJWT(t, j, u, user.Email, resp)
+
+		sessions := u.sessions.List(user.Email)
+		if len(sessions) != 1 || sessions[0].ExpiresAt != time.Unix(0, sessions[0].CreatedAt).Add(jwtLifetime).UnixNano() {
+			t.Fatalf("Expected the session to expire with its token but got %v", sessions)
+		}
+
+		if deleted := u.sessions.DeleteExpired(time.Now()); deleted != 0 {
+			t.Errorf("Expected no sessions to be swept but got %d", deleted)
+		}
+		if deleted := u.sessions.DeleteExpired(time.Now().Add(jwtLifetime)); deleted != 1 {
+			t.Errorf("Expected the session to be swept but got %d", deleted)
+		}
+		if sessions := u.sessions.List(user.Email); len(sessions) != 0 {
+			t.Errorf("Unexpected sessions %v", sessions)
+		}
+	})
+}
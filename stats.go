@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cakeStatsTop      = 10
+	cakeStatsMaxTop   = 100
+	cakeStatsDays     = 7
+	cakeStatsKeepDays = 90
+)
+
+type CakeCount struct {
+	CakeID string
+	Count  int
+}
+
+type CakeDay struct {
+	Day     string
+	Changes []CakeCount
+}
+
+// CakeStats counts fans per cake as favorites are set and changed, and keeps
+// the net changes of each day for the trend. A fan is a user whose #1 pick
+// the cake is.
+type CakeStats struct {
+	lock   sync.RWMutex
+	counts map[string]int
+	days   map[string]map[string]int
+	now    func() time.Time
+}
+
+// NewCakeStats counts the favorites of users once; after that the stats are
+// kept up to date by Add and Change.
+func NewCakeStats(users []User) *CakeStats {
+	s := &CakeStats{
+		counts: make(map[string]int),
+		days:   make(map[string]map[string]int),
+		now:    time.Now,
+	}
+	for _, user := range users {
+		s.counts[user.FavoriteCakeID]++
+	}
+	return s
+}
+
+func statsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func (s *CakeStats) Add(cakeID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counts[cakeID]++
+}
+
+func (s *CakeStats) Change(from, to string) {
+	if from == to {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counts[from]--
+	if s.counts[from] <= 0 {
+		delete(s.counts, from)
+	}
+	s.counts[to]++
+
+	now := s.now()
+	day := statsDay(now)
+	if s.days[day] == nil {
+		s.days[day] = make(map[string]int)
+		s.prune(now)
+	}
+	s.days[day][from]--
+	s.days[day][to]++
+}
+
+func (s *CakeStats) prune(now time.Time) {
+	oldest := statsDay(now.AddDate(0, 0, -cakeStatsKeepDays))
+	for day := range s.days {
+		if day < oldest {
+			delete(s.days, day)
+		}
+	}
+}
+
+// Top ranks cakes by fans, ties broken by id; n <= 0 returns all of them.
+func (s *CakeStats) Top(n int) []CakeCount {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return rankCakes(s.counts, n)
+}
+
+func rankCakes(counts map[string]int, n int) []CakeCount {
+	ranked := make([]CakeCount, 0, len(counts))
+	for id, count := range counts {
+		ranked = append(ranked, CakeCount{CakeID: id, Count: count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].CakeID < ranked[j].CakeID
+	})
+	if n > 0 && len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// Trend returns the net changes of the last days, today included, oldest
+// first. Days without changes are skipped.
+func (s *CakeStats) Trend(days int) []CakeDay {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := s.now()
+	trend := []CakeDay{}
+	for i := days - 1; i >= 0; i-- {
+		day := statsDay(now.AddDate(0, 0, -i))
+		changes := map[string]int{}
+		for id, delta := range s.days[day] {
+			if delta != 0 {
+				changes[id] = delta
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		trend = append(trend, CakeDay{Day: day, Changes: rankCakes(changes, 0)})
+	}
+	return trend
+}
+
+func queryInt(r *http.Request, name string, def, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > max {
+		return 0, errors.New(name + " must be a number from 1 to " + strconv.Itoa(max))
+	}
+	return n, nil
+}
+
+func (s *UserService) cakeStatsHandler(w http.ResponseWriter, r *http.Request, u User) {
+	top, err := queryInt(r, "top", cakeStatsTop, cakeStatsMaxTop)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	days, err := queryInt(r, "days", cakeStatsDays, cakeStatsKeepDays)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	lines := []string{"top " + strconv.Itoa(top) + " cakes by fans:"}
+	for i, count := range s.stats.Top(top) {
+		lines = append(lines, strconv.Itoa(i+1)+". "+s.cakeName(count.CakeID)+" "+strconv.Itoa(count.Count))
+	}
+
+	lines = append(lines, "changes over "+strconv.Itoa(days)+" days:")
+	for _, day := range s.stats.Trend(days) {
+		changes := []string{}
+		for _, change := range day.Changes {
+			delta := strconv.Itoa(change.Count)
+			if change.Count > 0 {
+				delta = "+" + delta
+			}
+			changes = append(changes, s.cakeName(change.CakeID)+" "+delta)
+		}
+		lines = append(lines, day.Day+" "+strings.Join(changes, ", "))
+	}
+
+	writeResponse(w, http.StatusOK, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCakeStats(t *testing.T) {
+	doRequest := createRequester(t)
+
+	u := newTestUserService()
+	j := newTestJwtService(t)
+
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	u.stats.now = func() time.Time { return now }
+
+	regs := httptest.NewServer(http.HandlerFunc(u.Register))
+	upds := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.UpdateFavoriteCakeHandler)))
+	stats := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permProfileRead, u.cakeStatsHandler))))
+	defer func() {
+		regs.Close()
+		upds.Close()
+		stats.Close()
+	}()
+
+	for i, cake := range []string{"cheesecake", "cheesecake", "napoleon", "tiramisu"} {
+		email := string(rune('w'+i)) + "@mail.com"
+		resp := doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, Params{
+			"email":         email,
+			"password":      DefaultPassword + "cake",
+			"favorite_cake": cake,
+		})))
+		assertStatus(t, http.StatusCreated, resp)
+		verifyEmail(t, u, email)
+	}
+
+	update := func(email, cake string) {
+		user, _ := u.repository.Get(email)
+		jwt, _ := j.GenearateJWT(user)
+		req, err := http.NewRequest(http.MethodPost, upds.URL, prepareParams(t, Params{
+			"favorite_cake": cake,
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+jwt,
+		)
+		assertStatus(t, http.StatusOK, doRequest(req, err))
+	}
+
+	update("z@mail.com", "napoleon")
+	now = now.AddDate(0, 0, 1)
+	update("w@mail.com", "napoleon")
+	update("x@mail.com", "millefeuille")
+
+	user, _ := u.repository.Get("w@mail.com")
+	jwt, _ := j.GenearateJWT(user)
+	getStats := func(query string) parsedResponse {
+		req, err := http.NewRequest(http.MethodGet, stats.URL+query, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+jwt,
+		)
+		return doRequest(req, err)
+	}
+
+	resp := getStats("?top=2")
+	assertResponse(t, http.StatusOK, "top 2 cakes by fans:\n"+
+		"1. napoleon 4\n"+
+		"changes over 7 days:\n"+
+		"2024-03-10 napoleon +1, tiramisu -1\n"+
+		"2024-03-11 napoleon +2, cheesecake -2", resp)
+
+	resp = getStats("?days=1")
+	assertResponse(t, http.StatusOK, "top 10 cakes by fans:\n"+
+		"1. napoleon 4\n"+
+		"changes over 1 days:\n"+
+		"2024-03-11 napoleon +2, cheesecake -2", resp)
+
+	resp = getStats("?top=0")
+	assertResponse(t, 422, "top must be a number from 1 to 100", resp)
+}
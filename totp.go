@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod         = 30
+	totpDigits         = 6
+	totpSkew           = 1
+	twoFactorPurpose   = "2fa"
+	recoveryCodesCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TwoFactorParams struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode implements RFC 6238 with the RFC 4226 dynamic truncation.
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	h := hmac.New(sha1.New, secret)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// matchTOTP returns the time step the code belongs to, accepting one step of
+// clock skew and never a step at or before lastStep so codes can't be replayed.
+func matchTOTP(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func (s *UserService) provisioningURI(email, secret string) string {
+	issuer := s.twoFactor.Issuer
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+email) + "?" + v.Encode()
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodesCount)
+	digests := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:5] + "-" + code[5:]
+		digests[i] = hashToken(codes[i])
+	}
+	return codes, digests, nil
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code, consuming whichever matched. The caller persists user.
+func checkSecondFactor(user *User, code string, now time.Time) bool {
+	code = strings.TrimSpace(code)
+
+	if step, ok := matchTOTP(user.TOTPSecret, code, now, user.TOTPLastStep); ok {
+		user.TOTPLastStep = step
+		return true
+	}
+
+	if user.RecoveryCodes == nil {
+		return false
+	}
+
+	digest := hashToken(strings.ToLower(code))
+	for i, recovery := range *user.RecoveryCodes {
+		if hmac.Equal([]byte(recovery), []byte(digest)) {
+			remaining := append(append([]string{}, (*user.RecoveryCodes)[:i]...), (*user.RecoveryCodes)[i+1:]...)
+			user.RecoveryCodes = &remaining
+			return true
+		}
+	}
+	return false
+}
+
+func (s *UserService) startTwoFactorChallenge(user User) (string, error) {
+	token, signed, err := s.tokens.Sign(twoFactorPurpose, user.Email, time.Duration(s.twoFactor.ChallengeTTL))
+	if err != nil {
+		return "", err
+	}
+
+	user.TOTPChallengeNonce = token.Nonce
+	if err := s.repository.Update(user.Email, user); err != nil {
+		return "", err
+	}
+
+	return signed, nil
+}
+
+func (s *UserService) TwoFactorLogin(
+	w http.ResponseWriter,
+	r *http.Request,
+	jwtService *JWTService,
+) {
+	params := &TwoFactorParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	challenge, err := s.tokens.Verify(twoFactorPurpose, params.Challenge)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	user, err := s.repository.Get(challenge.Subject)
+	if err != nil || !user.TOTPEnabled || user.TOTPChallengeNonce != challenge.Nonce {
+		handleError(errors.New("invalid or expired token"), w)
+		return
+	}
+
+	if UserHasBan(user) {
+		s.recordLogin(r, user.Email, loginBanned)
+		writeResponse(w, 401, "user "+user.Email+" has ban due to '"+(*user.BanHistory)[len(*user.BanHistory)-1].WhyBanned+"'")
+		return
+	}
+
+	now := time.Now()
+	if isLockedOut(w, user, now) {
+		s.recordLogin(r, user.Email, loginLockedOut)
+		return
+	}
+
+	if !checkSecondFactor(&user, params.Code, now) {
+		s.recordLogin(r, user.Email, loginBadSecondFactor)
+		s.recordFailedLogin(user, now)
+		handleError(errors.New("invalid two-factor code"), w)
+		return
+	}
+
+	user.TOTPChallengeNonce = ""
+	if err := s.repository.Update(user.Email, user); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	s.issueJWT(w, r, user, jwtService)
+}
+
+func (s *UserService) EnrollTwoFactorHandler(w http.ResponseWriter, r *http.Request, u User) {
+	if u.TOTPEnabled {
+		handleError(errors.New("two-factor authentication is already enabled"), w)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	u.TOTPPendingSecret = secret
+	if err := s.repository.Update(u.Email, u); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, s.provisioningURI(u.Email, secret))
+}
+
+func (s *UserService) ConfirmTwoFactorHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &TwoFactorParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if u.TOTPPendingSecret == "" {
+		handleError(errors.New("two-factor enrollment was not started"), w)
+		return
+	}
+
+	step, ok := matchTOTP(u.TOTPPendingSecret, strings.TrimSpace(params.Code), time.Now(), 0)
+	if !ok {
+		handleError(errors.New("invalid two-factor code"), w)
+		return
+	}
+
+	codes, digests, err := generateRecoveryCodes()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	u.TOTPEnabled = true
+	u.TOTPSecret = u.TOTPPendingSecret
+	u.TOTPPendingSecret = ""
+	u.TOTPLastStep = step
+	u.RecoveryCodes = &digests
+
+	if err := s.repository.Update(u.Email, u); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, strings.Join(codes, "\n"))
+	s.notifier <- []byte("enabled 2fa: " + u.Email)
+}
+
+func (s *UserService) DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request, u User) {
+	params := &TwoFactorParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if !u.TOTPEnabled {
+		handleError(errors.New("two-factor authentication is not enabled"), w)
+		return
+	}
+
+	if s.policy.RequiresTwoFactor(u.Role) {
+		writeResponse(w, 401, "two-factor authentication is required for role "+u.Role.String())
+		return
+	}
+
+	if !checkSecondFactor(&u, params.Code, time.Now()) {
+		handleError(errors.New("invalid two-factor code"), w)
+		return
+	}
+
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+
+	if err := s.repository.Update(u.Email, u); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "two-factor authentication disabled")
+	s.notifier <- []byte("disabled 2fa: " + u.Email)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func currentTOTP(t *testing.T, secret string, offset int64) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("Invalid totp secret %s", secret)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod+offset)
+}
+
+func TestTOTP(t *testing.T) {
+	t.Run("rfc 6238 vectors", func(t *testing.T) {
+		key := []byte("12345678901234567890")
+
+		for unix, expected := range map[int64]string{
+			59:         "287082",
+			1111111109: "081804",
+			1234567890: "005924",
+		} {
+			if code := totpCode(key, unix/totpPeriod); code != expected {
+				t.Errorf("Unexpected code at %d. Expected: %s, actual: %s", unix, expected, code)
+			}
+		}
+	})
+
+	t.Run("codes can not be replayed", func(t *testing.T) {
+		now := time.Unix(59, 0)
+
+		step, ok := matchTOTP(testTOTPSecret, "287082", now, 0)
+		if !ok {
+			t.Fatalf("Expected code to match")
+		}
+
+		if _, ok := matchTOTP(testTOTPSecret, "287082", now, step); ok {
+			t.Errorf("Expected used code to be rejected")
+		}
+	})
+}
+
+func TestUsers_TwoFactor(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("enroll and login with second factor", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		enrolls := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.EnrollTwoFactorHandler)))
+		confirms := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.ConfirmTwoFactorHandler)))
+		disables := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.DisableTwoFactorHandler)))
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		twoFactors := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.TwoFactorLogin)))
+		defer func() {
+			enrolls.Close()
+			confirms.Close()
+			disables.Close()
+			jwts.Close()
+			twoFactors.Close()
+		}()
+
+		user := newUser()
+		userJwt, _ := j.GenearateJWT(user)
+		u.repository.Add(user.Email, user)
+
+		req, err := http.NewRequest(http.MethodPost, enrolls.URL, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp := doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+
+		uri, err := url.Parse(string(resp.body))
+		if err != nil || uri.Scheme != "otpauth" || uri.Query().Get("issuer") != "Cake" {
+			t.Fatalf("Unexpected provisioning uri %s", resp.body)
+		}
+		secret := uri.Query().Get("secret")
+
+		req, err = http.NewRequest(http.MethodPost, confirms.URL, prepareParams(t, Params{
+			"code": "000000",
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 422, "invalid two-factor code", resp)
+
+		code := currentTOTP(t, secret, 0)
+		req, err = http.NewRequest(http.MethodPost, confirms.URL, prepareParams(t, Params{
+			"code": code,
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp = doRequest(req, err)
+		assertStatus(t, http.StatusOK, resp)
+
+		recovery := strings.Split(string(resp.body), "\n")
+		if len(recovery) != recoveryCodesCount {
+			t.Fatalf("Expected %d recovery codes, got %d", recoveryCodesCount, len(recovery))
+		}
+
+		if msg := string(<-u.notifier); msg != "enabled 2fa: "+user.Email {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+
+		login := func() string {
+			resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+				"email":    user.Email,
+				"password": DefaultPassword,
+			})))
+			assertStatus(t, http.StatusAccepted, resp)
+			return string(resp.body)
+		}
+
+		challenge := login()
+
+		resp = doRequest(http.NewRequest(http.MethodPost, twoFactors.URL, prepareParams(t, Params{
+			"challenge": challenge,
+			"code":      code,
+		}))) // code was already used to confirm
+		assertResponse(t, 422, "invalid two-factor code", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, twoFactors.URL, prepareParams(t, Params{
+			"challenge": challenge,
+			"code":      recovery[0],
+		})))
+		assertStatus(t, http.StatusOK, resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, twoFactors.URL, prepareParams(t, Params{
+			"challenge": challenge,
+			"code":      recovery[1],
+		}))) // challenge is single use
+		assertResponse(t, 422, "invalid or expired token", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, twoFactors.URL, prepareParams(t, Params{
+			"challenge": login(),
+			"code":      recovery[0],
+		}))) // recovery code is single use
+		assertResponse(t, 422, "invalid two-factor code", resp)
+
+		req, err = http.NewRequest(http.MethodPost, disables.URL, prepareParams(t, Params{
+			"code": currentTOTP(t, secret, 1),
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+userJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, http.StatusOK, "two-factor authentication disabled", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, Params{
+			"email":    user.Email,
+			"password": DefaultPassword,
+		})))
+		assertStatus(t, http.StatusOK, resp)
+	})
+
+	t.Run("admin without second factor", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		inspects := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.policy.Require(permUsersInspect, u.inspectUserHandler))))
+		disables := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.DisableTwoFactorHandler)))
+		defer func() {
+			inspects.Close()
+			disables.Close()
+		}()
+
+		admin := newAdmin()
+		admin.TOTPEnabled = false
+		adminJwt, _ := j.GenearateJWT(admin)
+		u.repository.Add(admin.Email, admin)
+
+		req, err := http.NewRequest(http.MethodGet, inspects.URL+"?email="+admin.Email, nil)
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp := doRequest(req, err)
+		assertResponse(t, 401, "two-factor authentication is required for role admin", resp)
+
+		admin.TOTPEnabled = true
+		u.repository.Update(admin.Email, admin)
+
+		req, err = http.NewRequest(http.MethodPost, disables.URL, prepareParams(t, Params{
+			"code": currentTOTP(t, testTOTPSecret, 0),
+		}))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+adminJwt,
+		)
+		resp = doRequest(req, err)
+		assertResponse(t, 401, "two-factor authentication is required for role admin", resp)
+	})
+}
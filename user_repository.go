@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"sort"
 	"sync"
 )
 
@@ -18,6 +19,9 @@ func NewInMemoryUserStorage() *InMemoryUserStorage {
 }
 
 func (s *InMemoryUserStorage) Add(key string, user User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if s.storage[key] != (User{}) {
 		return errors.New("Key '" + key + "' already exists")
 	}
@@ -27,6 +31,9 @@ func (s *InMemoryUserStorage) Add(key string, user User) error {
 }
 
 func (s *InMemoryUserStorage) Update(key string, user User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if s.storage[key] == (User{}) {
 		return errors.New("Key '" + key + "' doesn't exist")
 	}
@@ -36,6 +43,9 @@ func (s *InMemoryUserStorage) Update(key string, user User) error {
 }
 
 func (s *InMemoryUserStorage) Get(key string) (user User, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	user, exists := s.storage[key]
 	if exists {
 		return user, nil
@@ -44,6 +54,9 @@ func (s *InMemoryUserStorage) Get(key string) (user User, err error) {
 }
 
 func (s *InMemoryUserStorage) Delete(key string) (user User, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	user, exists := s.storage[key]
 	if exists {
 		delete(s.storage, key)
@@ -51,3 +64,15 @@ func (s *InMemoryUserStorage) Delete(key string) (user User, err error) {
 	}
 	return (User{}), errors.New("Key '" + key + "' doesn't exist")
 }
+
+func (s *InMemoryUserStorage) List() []User {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	users := make([]User, 0, len(s.storage))
+	for _, user := range s.storage {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return users
+}
@@ -1,21 +1,16 @@
 package main
 
-type Role int
+type Role string
 
 const (
-	userRole Role = iota
-	adminRole
-	superadminRole
+	userRole       Role = "user"
+	adminRole      Role = "admin"
+	superadminRole Role = "superadmin"
 )
 
 func (r Role) String() string {
-	switch r {
-	case userRole:
-		return "user"
-	case adminRole:
-		return "admin"
-	case superadminRole:
-		return "superadmin"
+	if r == "" {
+		return "unknown"
 	}
-	return "unknown"
+	return string(r)
 }
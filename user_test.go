@@ -8,8 +8,13 @@ import (
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
 	"strconv"
 	"testing"
+	"time"
+
+	"github.com/Hudanov/Cake-REST-API/config"
 )
 
 const DefaultPassword = "12345678"
@@ -47,6 +52,29 @@ func createRequester(t *testing.T) func(req *http.Request, err error) parsedResp
 	}
 }
 
+// createSender is createRequester for authorized requests: it sends params
+// with a jwt of actor.
+func createSender(t *testing.T, j *JWTService) func(method, url string, actor User, params Params) parsedResponse {
+	doRequest := createRequester(t)
+	return func(method, url string, actor User, params Params) parsedResponse {
+		jwt, _ := j.GenearateJWT(actor)
+		req, err := http.NewRequest(method, url, prepareParams(t, params))
+		req.Header.Add(
+			"Authorization",
+			"Bearer "+jwt,
+		)
+		return doRequest(req, err)
+	}
+}
+
+// expectEvent fails unless event is the next notification.
+func expectEvent(t *testing.T, u *UserService, event string) {
+	t.Helper()
+	if msg := string(<-u.notifier); msg != event {
+		t.Errorf("Unexpected event %s", msg)
+	}
+}
+
 func prepareParams(t *testing.T, params map[string]interface{}) io.Reader {
 	body, err := json.Marshal(params)
 	if err != nil {
@@ -59,9 +87,77 @@ func prepareParams(t *testing.T, params map[string]interface{}) io.Reader {
 func newTestUserService() *UserService {
 	return &UserService{
 		repository: NewInMemoryUserStorage(),
-		notifier:   make(chan []byte, 10),
-		reg:        make(chan bool, 5),
-		cake:       make(chan bool, 5),
+		policy:     DefaultPolicy(),
+		lockout:    NewLockoutPolicy(config.Default().Login),
+		passwords:  NewPasswordPolicy(config.Default().Password),
+		mailer:     NewInMemoryMailer(),
+		tokens:     &TokenSigner{secret: []byte("test secret"), now: time.Now},
+		resets:     NewInMemoryPasswordResetStorage(),
+		emailCfg:   config.Default().Email,
+		twoFactor:  config.Default().TwoFactor,
+		apiKeys:    NewInMemoryAPIKeyStorage(),
+		apiKeysCfg: config.Default().APIKeys,
+		sessions:   NewInMemorySessionStorage(),
+		logins:     NewInMemoryLoginHistory(config.Default().Login.HistorySize),
+		audit:      NewInMemoryAuditLog(),
+		invites:    NewInMemoryInviteStorage(),
+		domains:    testDomainPolicy(),
+		cakes:      testCakeCatalog(),
+		stats:      NewCakeStats(nil),
+		reviews:    NewInMemoryReviewStorage(),
+		orders:     NewInMemoryOrderStorage(),
+		gifts:      NewInMemoryGiftStorage(),
+		giftsCfg:   config.Default().Gifts,
+		recipes:    NewInMemoryRecipeStorage(),
+		birthdays:  NewInMemoryBirthdayLog(),
+
+		recommender: NewRecommender(),
+		clock:       time.Now,
+
+		impersonationTTL: config.Default().API.ImpersonationTTL,
+
+		notifier: make(chan []byte, 10),
+		reg:      make(chan bool, 5),
+		cake:     make(chan bool, 5),
+	}
+}
+
+func testDomainPolicy() *DomainPolicy {
+	domains, _ := NewDomainPolicy(config.Default().Domains)
+	return domains
+}
+
+func testCakeCatalog() *InMemoryCakeStorage {
+	cakes := NewInMemoryCakeStorage()
+	for _, cake := range DefaultCakes() {
+		cakes.Add(cake)
+	}
+	return cakes
+}
+
+var mailedTokenRe = regexp.MustCompile(`token=([^\s]+)`)
+
+func mailedToken(t *testing.T, u *UserService, email string) string {
+	mail, ok := u.mailer.(*InMemoryMailer).Last(email)
+	if !ok {
+		t.Fatalf("No mail was sent to %s", email)
+	}
+
+	match := mailedTokenRe.FindStringSubmatch(mail.Body)
+	if match == nil {
+		t.Fatalf("No token in mail to %s: %s", email, mail.Body)
+	}
+
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func verifyEmail(t *testing.T, u *UserService, email string) {
+	if _, err := u.verifyEmail(mailedToken(t, u, email)); err != nil {
+		t.Fatalf("Could not verify %s: %v", email, err)
 	}
 }
 
@@ -91,6 +187,21 @@ func assertResponse(t *testing.T, status int, body string, r parsedResponse) {
 	assertBody(t, body, r)
 }
 
+func assertSessionJWT(t *testing.T, j *JWTService, u *UserService, email string, r parsedResponse) {
+	assertStatus(t, http.StatusOK, r)
+
+	auth, err := j.ParseJWT(string(r.body))
+	if err != nil {
+		t.Fatalf("Unexpected jwt %s: %v", r.body, err)
+	}
+	if auth.Email != email {
+		t.Errorf("Unexpected jwt email. Expected: %s, actual: %s", email, auth.Email)
+	}
+	if session, err := u.sessions.Get(auth.UID); err != nil || session.Email != email {
+		t.Errorf("Jwt must belong to a session of %s", email)
+	}
+}
+
 func randomNum() string {
 	return strconv.FormatInt(int64(rand.Intn(1000)), 10)
 }
@@ -99,17 +210,22 @@ func newUser() User {
 	return User{
 		Email:          randomNum() + "user@mail.com",
 		PasswordDigest: encrypt("12345678"),
-		FavoriteCake:   "cheesecake",
+		FavoriteCakeID: "cheesecake",
 		Role:           userRole,
 	}
 }
 
+// testTOTPSecret is the RFC 6238 SHA1 test key "12345678901234567890".
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
 func newAdmin() User {
 	return User{
 		Email:          randomNum() + "admin@mail.com",
 		PasswordDigest: encrypt("12345678"),
-		FavoriteCake:   "cheesecake",
+		FavoriteCakeID: "cheesecake",
 		Role:           adminRole,
+		TOTPEnabled:    true,
+		TOTPSecret:     testTOTPSecret,
 	}
 }
 
@@ -117,8 +233,10 @@ func newSuperadmin() User {
 	return User{
 		Email:          randomNum() + "superadmin@mail.com",
 		PasswordDigest: encrypt("12345678"),
-		FavoriteCake:   "cheesecake",
+		FavoriteCakeID: "cheesecake",
 		Role:           superadminRole,
+		TOTPEnabled:    true,
+		TOTPSecret:     testTOTPSecret,
 	}
 }
 
@@ -176,6 +294,100 @@ func TestUsers_JWT(t *testing.T) {
 		assertResponse(t, 422, "invalid login params", resp)
 	})
 
+	t.Run("lockout after failed logins", func(t *testing.T) {
+		u := newTestUserService()
+		u.lockout = LockoutPolicy{MaxFailedLogins: 2, Base: time.Minute, Max: time.Hour}
+		j := newTestJwtService(t)
+
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer func() {
+			jwts.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		wrongParams := map[string]interface{}{
+			"email":    user.Email,
+			"password": "wrongpass",
+		}
+
+		rightParams := map[string]interface{}{
+			"email":    user.Email,
+			"password": DefaultPassword,
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, wrongParams)))
+		assertResponse(t, 422, "invalid login params", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, wrongParams)))
+		assertResponse(t, 422, "invalid login params", resp)
+
+		req, _ := http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, rightParams))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "60" {
+			t.Errorf("Expected 429 with Retry-After 60, got %d with '%s'", res.StatusCode, res.Header.Get("Retry-After"))
+		}
+
+		locked, _ := u.repository.Get(user.Email)
+		if locked.FailedLogins != 2 {
+			t.Errorf("Expected 2 failed logins recorded, got %d", locked.FailedLogins)
+		}
+
+		if lockout := u.lockout.lockoutFor(4); lockout != 4*time.Minute {
+			t.Errorf("Expected lockout to grow to 4m, got %v", lockout)
+		}
+
+		locked.LockedUntil = time.Now().Add(-time.Second).UnixNano()
+		u.repository.Update(locked.Email, locked)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, rightParams)))
+		assertStatus(t, 200, resp)
+
+		if unlocked, _ := u.repository.Get(user.Email); unlocked.FailedLogins != 0 || unlocked.LockedUntil != 0 {
+			t.Errorf("Expected failed logins to be reset, got %v", unlocked)
+		}
+	})
+
+	t.Run("login rate limit", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		limiter := &LoginLimiter{
+			ip:      NewRateLimiter(60, 3),
+			account: NewRateLimiter(60, 1),
+		}
+		jwts := httptest.NewServer(http.HandlerFunc(limiter.Limit(wrapJwt(j, u.JWT))))
+		defer func() {
+			jwts.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		params := map[string]interface{}{
+			"email":    user.Email,
+			"password": DefaultPassword,
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, params))) // account bucket is empty
+		assertResponse(t, http.StatusTooManyRequests, "too many login attempts, try again later", resp)
+
+		params["email"] = "other@mail.com"
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, params)))
+		assertStatus(t, 422, resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, params))) // ip bucket is empty
+		assertResponse(t, http.StatusTooManyRequests, "too many login attempts, try again later", resp)
+	})
+
 	t.Run("right jwt", func(t *testing.T) {
 		u := newTestUserService()
 		j := newTestJwtService(t)
@@ -194,8 +406,7 @@ func TestUsers_JWT(t *testing.T) {
 		}
 
 		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, jwtParams)))
-		jwt, _ := j.GenearateJWT(user)
-		assertResponse(t, 200, jwt, resp)
+		assertSessionJWT(t, j, u, user.Email, resp)
 	})
 
 	t.Run("update cake", func(t *testing.T) {
@@ -288,6 +499,7 @@ func TestUsers_JWT(t *testing.T) {
 		}
 
 		doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, regParams)))
+		verifyEmail(t, u, "test@mail.com")
 		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, jwtParams)))
 
 		jwt := string(resp.body)
@@ -306,6 +518,11 @@ func TestUsers_JWT(t *testing.T) {
 		assertStatus(t, 422, resp)
 		assertBody(t, "Key 'test@mail.com' doesn't exist", resp)
 
+		resp = doRequest(http.NewRequest(http.MethodGet, jwts.URL, prepareParams(t, jwtUpdatedParams)))
+		assertResponse(t, 401, "email new@mail.com is not verified", resp)
+
+		verifyEmail(t, u, "new@mail.com")
+
 		resp = doRequest(http.NewRequest(http.MethodGet, jwts.URL, prepareParams(t, jwtUpdatedParams)))
 		assertStatus(t, 200, resp)
 		if jwt := string(resp.body); jwt == "Key 'new@mail.com' doesn't exist" {
@@ -313,6 +530,144 @@ func TestUsers_JWT(t *testing.T) {
 		}
 	})
 
+	t.Run("reset forgotten password", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+		j.sessions = u.sessions
+
+		forgots := httptest.NewServer(http.HandlerFunc(u.ForgotPasswordHandler))
+		resets := httptest.NewServer(http.HandlerFunc(u.ResetPasswordHandler))
+		jwts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		cks := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.getCakeHandler)))
+		defer func() {
+			forgots.Close()
+			resets.Close()
+			jwts.Close()
+			cks.Close()
+		}()
+
+		user := newUser()
+		u.repository.Add(user.Email, user)
+
+		getCake := func(jwt string) parsedResponse {
+			req, err := http.NewRequest(http.MethodGet, cks.URL, nil)
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+jwt,
+			)
+			return doRequest(req, err)
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, map[string]interface{}{
+			"email":    user.Email,
+			"password": DefaultPassword,
+		})))
+		assertSessionJWT(t, j, u, user.Email, resp)
+		userJwt := string(resp.body)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, forgots.URL, prepareParams(t, map[string]interface{}{
+			"email": "nobody@mail.com",
+		})))
+		assertResponse(t, http.StatusOK, "if the account exists, a reset link has been sent", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, forgots.URL, prepareParams(t, map[string]interface{}{
+			"email": user.Email,
+		})))
+		assertResponse(t, http.StatusOK, "if the account exists, a reset link has been sent", resp)
+
+		token := mailedToken(t, u, user.Email)
+		if reset, _ := u.resets.Last(user.Email); reset.TokenDigest == token {
+			t.Errorf("Reset token must be stored hashed")
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, resets.URL, prepareParams(t, map[string]interface{}{
+			"token":    "wrong",
+			"password": "brandnewpass",
+		})))
+		assertResponse(t, 422, "invalid or expired token", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, resets.URL, prepareParams(t, map[string]interface{}{
+			"token":    token,
+			"password": "short",
+		})))
+		assertStatus(t, 422, resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, resets.URL, prepareParams(t, map[string]interface{}{
+			"token":    token,
+			"password": DefaultPassword,
+		}))) // a reused password does not burn the link either
+		assertStatus(t, 422, resp)
+
+		link := resets.URL + "?token=" + url.QueryEscape(token)
+		resp = doRequest(http.NewRequest(http.MethodGet, link, nil))
+		assertResponse(t, http.StatusOK, "the link is valid, post your new password to it", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, link, prepareParams(t, map[string]interface{}{
+			"password": "brandnewpass",
+		})))
+		assertResponse(t, http.StatusOK, "password reset", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, resets.URL, prepareParams(t, map[string]interface{}{
+			"token":    token,
+			"password": "anothernewpass",
+		}))) // token is single use
+		assertResponse(t, 422, "invalid or expired token", resp)
+
+		resp = getCake(userJwt) // sessions are revoked
+		assertResponse(t, 401, "unauthorized", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, map[string]interface{}{
+			"email":    user.Email,
+			"password": "brandnewpass",
+		})))
+		assertSessionJWT(t, j, u, user.Email, resp)
+
+		resp = getCake(string(resp.body)) // a login right after the reset works
+		assertResponse(t, http.StatusOK, "cheesecake", resp)
+
+		if msg := string(<-u.notifier); msg != "password reset: "+user.Email {
+			t.Errorf("Unexpected notification %s", msg)
+		}
+	})
+
+	t.Run("password history", func(t *testing.T) {
+		u := newTestUserService()
+		j := newTestJwtService(t)
+
+		upds := httptest.NewServer(http.HandlerFunc(j.JWTAuth(u.repository, u.UpdatePasswordHandler)))
+		defer func() {
+			upds.Close()
+		}()
+
+		user := newUser()
+		user.PasswordDigest = encrypt("firstpass")
+		u.repository.Add(user.Email, user)
+		userJwt, _ := j.GenearateJWT(user)
+
+		changePassword := func(password string) parsedResponse {
+			req, err := http.NewRequest(http.MethodPost, upds.URL, prepareParams(t, map[string]interface{}{
+				"password": password,
+			}))
+			req.Header.Add(
+				"Authorization",
+				"Bearer "+userJwt,
+			)
+			return doRequest(req, err)
+		}
+
+		assertResponse(t, 422, "password was used recently, choose one not among last 5", changePassword("firstpass"))
+		assertResponse(t, http.StatusOK, "password changed", changePassword("secondpass"))
+		assertResponse(t, http.StatusOK, "password changed", changePassword("thirdpass"))
+		assertResponse(t, 422, "password was used recently, choose one not among last 5", changePassword("firstpass"))
+
+		for _, p := range []string{"fourthpass", "fifthpass", "sixthpass"} {
+			assertResponse(t, http.StatusOK, "password changed", changePassword(p))
+		}
+
+		assertResponse(t, 422, "password was used recently, choose one not among last 5", changePassword("secondpass"))
+		assertResponse(t, http.StatusOK, "password changed", changePassword("firstpass"))
+	})
+
 	t.Run("update password", func(t *testing.T) {
 		u := newTestUserService()
 		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
@@ -350,6 +705,7 @@ func TestUsers_JWT(t *testing.T) {
 		}
 
 		doRequest(http.NewRequest(http.MethodPost, regs.URL, prepareParams(t, regParams)))
+		verifyEmail(t, u, "test@mail.com")
 		resp := doRequest(http.NewRequest(http.MethodPost, jwts.URL, prepareParams(t, jwtParams)))
 
 		jwt := string(resp.body)
@@ -7,9 +7,17 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+	"golang.org/x/text/unicode/norm"
 )
 
+const cakeNameMaxLength = 64
+
 type Ban struct {
 	WhoBanned    string
 	WhenBanned   int64
@@ -19,11 +27,31 @@ type Ban struct {
 }
 
 type User struct {
-	Email          string
-	PasswordDigest string
-	Role           Role
-	FavoriteCake   string
-	BanHistory     *[]Ban
+	Email              string
+	PasswordDigest     string
+	Role               Role
+	FavoriteCakeID     string
+	FavoriteCakes      *[]string
+	BanHistory         *[]Ban
+	MustChangePassword bool
+	FailedLogins       int
+	LockedUntil        int64
+	PasswordHistory    *[]string
+	CakeHistory        *[]string
+
+	Birthday string
+	Timezone string
+
+	PendingVerification bool
+	VerificationNonce   string
+	VerificationSentAt  int64
+
+	TOTPEnabled        bool
+	TOTPSecret         string
+	TOTPPendingSecret  string
+	TOTPLastStep       int64
+	TOTPChallengeNonce string
+	RecoveryCodes      *[]string
 }
 
 func UserHasBan(u User) bool {
@@ -103,33 +131,75 @@ type UserRepository interface {
 	Get(string) (User, error)
 	Update(string, User) error
 	Delete(string) (User, error)
+	List() []User
 }
 
 type UserService struct {
 	repository UserRepository
-	notifier   chan []byte
-	reg        chan bool
-	cake       chan bool
+	policy     *Policy
+	lockout    LockoutPolicy
+	passwords  PasswordPolicy
+	mailer     Mailer
+	tokens     *TokenSigner
+	resets     PasswordResetRepository
+	emailCfg   config.EmailConfig
+	twoFactor  config.TwoFactorConfig
+	apiKeys    APIKeyRepository
+	apiKeysCfg config.APIKeysConfig
+	sessions   SessionRepository
+	logins     LoginHistoryRepository
+	audit      AuditRepository
+	invites    InviteRepository
+	domains    *DomainPolicy
+	cakes      CakeRepository
+	stats      *CakeStats
+	reviews    ReviewRepository
+	orders     OrderRepository
+	gifts      GiftRepository
+	giftsCfg   config.GiftsConfig
+	recipes    RecipeRepository
+	birthdays  BirthdayLog
+
+	recommender *Recommender
+	clock       func() time.Time
+
+	impersonationTTL config.Duration
+
+	notifier chan []byte
+	reg      chan bool
+	cake     chan bool
 }
 
 type UserRegisterParams struct {
 	Email        string `json:"email"`
 	Password     string `json:"password"`
 	FavoriteCake string `json:"favorite_cake"`
+	Invite       string `json:"invite"`
 }
 
-func validateRegisterParams(p *UserRegisterParams) error {
-	err := validateEmail(p.Email)
+func (u *UserService) validateRegisterParams(p *UserRegisterParams) error {
+	email, err := u.normalizeEmail(p.Email)
 	if err != nil {
 		return err
 	}
+	p.Email = email
 
-	err = validatePassword(p.Password)
+	err = u.domains.Check(p.Email)
 	if err != nil {
 		return err
 	}
 
-	return validateCake(p.FavoriteCake)
+	err = u.passwords.Validate(p.Password, p.Email)
+	if err != nil {
+		return err
+	}
+
+	cake, err := u.resolveCake(p.FavoriteCake)
+	if err != nil {
+		return err
+	}
+	p.FavoriteCake = cake.ID
+	return nil
 }
 
 func validateEmail(email string) error {
@@ -141,27 +211,28 @@ func validateEmail(email string) error {
 	return nil
 }
 
-func validatePassword(password string) error {
-	// 2. Password at least 8 symbols
-	if len(password) < 8 {
-		return errors.New("password too short")
-	}
-	return nil
-}
+// normalizeCake returns cake in NFC with runs of spaces collapsed, so
+// names typed differently compare equal under cakeKey.
+func normalizeCake(cake string) (string, error) {
+	cake = strings.Join(strings.Fields(norm.NFC.String(cake)), " ")
 
-func validateCake(cake string) error {
 	// 3. Favorite cake not empty
 	if len(cake) == 0 {
-		return errors.New("favorite cake can't be empty")
+		return "", errors.New("favorite cake can't be empty")
 	}
 
-	// 4. Favorite cake only alphabetic
-	match, _ := regexp.Match(`\W`, []byte(cake))
-	if match {
-		return errors.New("favorite cake can contain only letters")
+	if utf8.RuneCountInString(cake) > cakeNameMaxLength {
+		return "", errors.New("favorite cake too long")
 	}
 
-	return nil
+	// 4. Favorite cake only letters, spaces and hyphens
+	for _, r := range cake {
+		if !unicode.IsLetter(r) && !unicode.IsMark(r) && r != ' ' && r != '-' {
+			return "", errors.New("favorite cake can contain only letters, spaces and hyphens")
+		}
+	}
+
+	return cake, nil
 }
 
 func (u *UserService) Register(w http.ResponseWriter, r *http.Request) {
@@ -170,18 +241,36 @@ func (u *UserService) Register(w http.ResponseWriter, r *http.Request) {
 		handleError(err, w)
 		return
 	}
+	// The mailed invite link carries its token in the query.
+	if params.Invite == "" {
+		params.Invite = r.URL.Query().Get("token")
+	}
 
-	if err := validateRegisterParams(params); err != nil {
+	if err := u.validateRegisterParams(params); err != nil {
 		handleError(err, w)
 		return
 	}
 
 	passwordDigest := md5.New().Sum([]byte(params.Password))
 	newUser := User{
-		Email:          params.Email,
-		PasswordDigest: string(passwordDigest),
-		FavoriteCake:   params.FavoriteCake,
-		Role:           userRole,
+		Email:               params.Email,
+		PasswordDigest:      string(passwordDigest),
+		FavoriteCakeID:      params.FavoriteCake,
+		Role:                userRole,
+		PendingVerification: true,
+	}
+	setFavoriteCakes(&newUser, []string{params.FavoriteCake})
+
+	// The invite link was mailed to the address, so it proves ownership.
+	var invite Invite
+	if params.Invite != "" {
+		invite, err = u.findInvite(params.Invite, params.Email)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+		newUser.Role = invite.Role
+		newUser.PendingVerification = false
 	}
 
 	err = u.repository.Add(params.Email, newUser)
@@ -189,9 +278,26 @@ func (u *UserService) Register(w http.ResponseWriter, r *http.Request) {
 		handleError(err, w)
 		return
 	}
+	u.stats.Add(newUser.FavoriteCakeID)
+
+	if params.Invite != "" {
+		err = u.invites.Delete(invite.Email)
+	} else {
+		err = u.sendVerification(&newUser)
+		if err == nil {
+			err = u.repository.Update(newUser.Email, newUser)
+		}
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
 
 	writeResponse(w, http.StatusCreated, "registered")
 	u.notifier <- []byte("registered: " + params.Email)
+	if params.Invite != "" {
+		u.notifier <- []byte("accepted invite: " + params.Email + " as " + newUser.Role.String())
+	}
 	registeredUsers.Inc()
 }
 
@@ -202,19 +308,21 @@ func (u *UserService) UpdateFavoriteCakeHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	if err := validateCake(params.FavoriteCake); err != nil {
+	cake, err := u.resolveCake(params.FavoriteCake)
+	if err != nil {
 		handleError(err, w)
 		return
 	}
 
 	newUser := user
-	newUser.FavoriteCake = params.FavoriteCake
+	setFavoriteCakes(&newUser, withTopCake(favoriteCakes(user), cake.ID))
 
 	err = u.repository.Update(newUser.Email, newUser)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	u.stats.Change(user.FavoriteCakeID, newUser.FavoriteCakeID)
 
 	writeResponse(w, http.StatusOK, "favorite cake changed")
 	u.notifier <- []byte("updated cake: " + newUser.Email)
@@ -227,13 +335,26 @@ func (u *UserService) UpdateEmailHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	if err := validateEmail(params.Email); err != nil {
+	email, err := u.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err := u.domains.Check(email); err != nil {
 		handleError(err, w)
 		return
 	}
 
 	newUser := user
-	newUser.Email = params.Email
+	newUser.Email = email
+	newUser.PendingVerification = true
+
+	err = u.repository.Add(newUser.Email, newUser)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
 
 	_, err = u.repository.Delete(user.Email)
 	if err != nil {
@@ -241,14 +362,23 @@ func (u *UserService) UpdateEmailHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	err = u.repository.Add(newUser.Email, newUser)
+	err = u.renameAccount(user.Email, newUser.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	err = u.sendVerification(&newUser)
+	if err == nil {
+		err = u.repository.Update(newUser.Email, newUser)
+	}
 	if err != nil {
 		handleError(err, w)
 		return
 	}
 
 	writeResponse(w, http.StatusOK, "email changed")
-	u.notifier <- []byte("updated email: " + newUser.Email + " -> " + params.Email)
+	u.notifier <- []byte("updated email: " + user.Email + " -> " + newUser.Email)
 }
 
 func (u *UserService) UpdatePasswordHandler(w http.ResponseWriter, r *http.Request, user User) {
@@ -258,13 +388,26 @@ func (u *UserService) UpdatePasswordHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if err := validatePassword(params.Password); err != nil {
+	if err := u.passwords.Validate(params.Password, user.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	passwordDigest := string(md5.New().Sum([]byte(params.Password)))
+	if user.MustChangePassword && passwordDigest == user.PasswordDigest {
+		handleError(errors.New("new password must differ from the current one"), w)
+		return
+	}
+
+	if err := u.passwords.CheckHistory(user, passwordDigest); err != nil {
 		handleError(err, w)
 		return
 	}
 
 	newUser := user
-	newUser.PasswordDigest = string(md5.New().Sum([]byte(params.Password)))
+	u.passwords.RememberPassword(&newUser)
+	newUser.PasswordDigest = passwordDigest
+	newUser.MustChangePassword = false
 
 	err = u.repository.Update(newUser.Email, newUser)
 	if err != nil {
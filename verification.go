@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const verifyPurpose = "verify"
+
+type TokenParams struct {
+	Token string `json:"token"`
+}
+
+func (s *UserService) sendMail(to, subject, body string) error {
+	return s.mailer.Send(Mail{
+		From:    s.emailCfg.From,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+		SentAt:  time.Now(),
+	})
+}
+
+func (s *UserService) link(path, token string) string {
+	return s.emailCfg.BaseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendVerification mails a fresh verification link and remembers its nonce
+// on the user, invalidating any link sent before. The caller persists user.
+func (s *UserService) sendVerification(user *User) error {
+	token, signed, err := s.tokens.Sign(verifyPurpose, user.Email, time.Duration(s.emailCfg.VerifyTTL))
+	if err != nil {
+		return err
+	}
+
+	user.VerificationNonce = token.Nonce
+	user.VerificationSentAt = time.Now().UnixNano()
+
+	return s.sendMail(user.Email, "Confirm your email",
+		"Open "+s.link("/user/verify", signed)+" to confirm your email. The link is valid until "+
+			token.Expires.UTC().Format(time.RFC1123)+".")
+}
+
+func (s *UserService) verifyEmail(token string) (User, error) {
+	invalid := errors.New("invalid or expired token")
+
+	t, err := s.tokens.Verify(verifyPurpose, token)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := s.repository.Get(t.Subject)
+	if err != nil || !user.PendingVerification || user.VerificationNonce != t.Nonce {
+		return User{}, invalid
+	}
+
+	user.PendingVerification = false
+	user.VerificationNonce = ""
+
+	if err := s.repository.Update(user.Email, user); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func readToken(r *http.Request) (string, error) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, nil
+	}
+
+	params := &TokenParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil || params.Token == "" {
+		return "", errors.New("could not read params")
+	}
+	return params.Token, nil
+}
+
+func (s *UserService) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := readToken(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	user, err := s.verifyEmail(token)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "email verified")
+	s.notifier <- []byte("verified: " + user.Email)
+}
+
+func (s *UserService) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := readParams(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	email, err := s.normalizeEmail(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	user, err := s.repository.Get(email)
+	if err == nil && user.PendingVerification {
+		next := time.Unix(0, user.VerificationSentAt).Add(time.Duration(s.emailCfg.ResendInterval))
+		if wait := time.Until(next); wait > 0 {
+			writeTooManyRequests(w, wait, "verification email was sent recently, try again later")
+			return
+		}
+
+		if err := s.sendVerification(&user); err != nil {
+			handleError(err, w)
+			return
+		}
+
+		if err := s.repository.Update(user.Email, user); err != nil {
+			handleError(err, w)
+			return
+		}
+	}
+
+	writeResponse(w, http.StatusOK, "if the email awaits verification, a new link has been sent")
+}
@@ -8,26 +8,16 @@ import (
 	ws "github.com/gorilla/websocket"
 )
 
-const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = pongWait * 9 / 10
-	maxMessageSize = 512
-)
-
-var upgrader = ws.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 type Client struct {
-	hub  *Hub
-	conn *ws.Conn
-	send chan []byte
+	hub   *Hub
+	conn  *ws.Conn
+	send  chan []byte
+	email string
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	writeWait := time.Duration(c.hub.cfg.WriteWait)
+	ticker := time.NewTicker(c.hub.cfg.PingPeriod())
 
 	defer func() {
 		ticker.Stop()
@@ -61,16 +51,22 @@ func (c *Client) writePump() {
 	}
 }
 
-func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
+func serveWS(hub *Hub, email string, w http.ResponseWriter, r *http.Request) {
+	upgrader := ws.Upgrader{
+		ReadBufferSize:  hub.cfg.ReadBufferSize,
+		WriteBufferSize: hub.cfg.WriteBufferSize,
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	client := &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, 256),
+		hub:   hub,
+		conn:  conn,
+		send:  make(chan []byte, hub.cfg.SendBuffer),
+		email: email,
 	}
 	client.hub.register <- client
 	client.hub.broadcast <- []byte("new")
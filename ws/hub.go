@@ -1,14 +1,22 @@
 package main
 
+import (
+	"bytes"
+
+	"github.com/Hudanov/Cake-REST-API/config"
+)
+
 type Hub struct {
+	cfg        config.WebSocketConfig
 	clients    map[*Client]bool
 	broadcast  chan []byte
 	register   chan *Client
 	unregister chan *Client
 }
 
-func NewHub() *Hub {
+func NewHub(cfg config.WebSocketConfig) *Hub {
 	return &Hub{
+		cfg:        cfg,
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
@@ -27,7 +35,11 @@ func (h Hub) run() {
 				close(client.send)
 			}
 		case msg := <-h.broadcast:
+			email, msg := recipient(msg)
 			for client := range h.clients {
+				if email != "" && client.email != email {
+					continue
+				}
 				select {
 				case client.send <- msg:
 				default:
@@ -38,3 +50,16 @@ func (h Hub) run() {
 		}
 	}
 }
+
+// recipient splits a message published as "@email event" into the user it
+// is meant for and the event. Other messages go to every client.
+func recipient(msg []byte) (string, []byte) {
+	if !bytes.HasPrefix(msg, []byte("@")) {
+		return "", msg
+	}
+	space := bytes.IndexByte(msg, ' ')
+	if space < 0 {
+		return "", msg
+	}
+	return string(msg[1:space]), msg[space+1:]
+}
@@ -1,20 +1,16 @@
 package main
 
 import (
+	"github.com/Hudanov/Cake-REST-API/config"
 	"github.com/openware/rango/pkg/auth"
 )
 
-const (
-	privKeyPath = "../keys/privkey.rsa"
-	pubKeyPath  = "../keys/pubkey.rsa"
-)
-
 type JWTService struct {
 	keys *auth.KeyStore
 }
 
-func NewJWTService() (*JWTService, error) {
-	keys, err := auth.LoadOrGenerateKeys(privKeyPath, pubKeyPath)
+func NewJWTService(cfg config.KeysConfig) (*JWTService, error) {
+	keys, err := auth.LoadOrGenerateKeys(cfg.PrivateKeyPath, cfg.PublicKeyPath)
 	if err != nil {
 		return nil, err
 	}
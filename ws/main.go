@@ -1,23 +1,36 @@
 package main
 
 import (
-	"flag"
 	"log"
 	"net/http"
 	"os"
 	"strings"
-)
 
-var wsPort = os.Getenv("WEBSOCKET_PORT")
-var addr = flag.String("addr", ":"+wsPort, "http service address")
+	"github.com/Hudanov/Cake-REST-API/config"
+)
 
 func main() {
-	flag.Parse()
-	hub := NewHub()
+	defaults := config.Default()
+	defaults.Keys.PrivateKeyPath = "../keys/privkey.rsa"
+	defaults.Keys.PublicKeyPath = "../keys/pubkey.rsa"
+
+	cfg, args, err := config.Load("ws", os.Args[1:], defaults)
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+
+	if len(args) > 0 {
+		if err := cfg.Run(args, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	hub := NewHub(cfg.WebSocket)
 	go hub.run()
-	go hub.receive()
+	go hub.receive(cfg.AMQP)
 
-	jwtService, err := NewJWTService()
+	jwtService, err := NewJWTService(cfg.Keys)
 	if err != nil {
 		panic(err)
 	}
@@ -25,16 +38,17 @@ func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if _, err := jwtService.ParseJWT(token); err != nil {
+		claims, err := jwtService.ParseJWT(token)
+		if err != nil {
 			w.WriteHeader(401)
 			w.Write([]byte("unauthorized"))
 			return
 		}
 
-		serveWS(hub, w, r)
+		serveWS(hub, claims.Email, w, r)
 	})
 
-	err = http.ListenAndServe(*addr, nil)
+	err = http.ListenAndServe(cfg.WebSocket.Addr, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -2,14 +2,13 @@ package main
 
 import (
 	"log"
-	"os"
 
+	"github.com/Hudanov/Cake-REST-API/config"
 	"github.com/streadway/amqp"
 )
 
-func (hub *Hub) receive() {
-	amqpPath := os.Getenv("RABBITMQ_CONN_PATH")
-	conn, err := amqp.Dial(amqpPath)
+func (hub *Hub) receive(cfg config.AMQPConfig) {
+	conn, err := amqp.Dial(cfg.URL.Value())
 	if err != nil {
 		log.Fatalf("Failed to connect to RabbitMQ: %s", err)
 	}
@@ -22,7 +21,7 @@ func (hub *Hub) receive() {
 	defer ch.Close()
 
 	q, err := ch.QueueDeclare(
-		"default",
+		cfg.Queue,
 		false,
 		false,
 		false,